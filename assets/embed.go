@@ -0,0 +1,10 @@
+// Package assets holds the index template, static files and default public
+// gallery compiled into the server. Build the wasm client into static/ first,
+// as make does, or the embedded page has no client to load. The private
+// gallery is never embedded, so binaries can be handed out freely.
+package assets
+
+import "embed"
+
+//go:embed index.html static gallery/pub
+var FS embed.FS
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"kraken/util"
+)
+
+// Open the access log, "-" meaning stdout. Returns nil if filename is empty.
+func openAccessLog(filename string, format util.LogFormat) (*util.Logger, error) {
+	if filename == "" {
+		return nil, nil
+	}
+
+	f := os.Stdout
+	if filename != "-" {
+		var err error
+		f, err = os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return util.NewLogger(util.WriterSink(f), format, util.LevelInfo), nil
+}
+
+type accessAttrsContextKey struct{}
+
+// Extra fields a handler adds to its request's access log line.
+type accessAttrs struct {
+	mu sync.Mutex // protects kv
+	kv []any
+}
+
+// Add key-value pairs to the access log line for r.
+func addAccessAttrs(r *http.Request, kv ...any) {
+	attrs, ok := r.Context().Value(accessAttrsContextKey{}).(*accessAttrs)
+	if !ok {
+		return
+	}
+	attrs.mu.Lock()
+	defer attrs.mu.Unlock()
+
+	attrs.kv = append(attrs.kv, kv...)
+}
+
+// Write a line to the access log once each request finishes. Virtual
+// requests are attributed to the websocket session they arrived through.
+func accessLogWrapper(access *util.Logger, kind string, h http.Handler) http.Handler {
+	if access == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		attrs := &accessAttrs{}
+		h.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), accessAttrsContextKey{}, attrs)))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		kv := []any{"kind", kind}
+		if session := sessionFromContext(r.Context()); session != nil {
+			kv = append(kv,
+				"client", session.ClientIP,
+				"session", session.ID,
+				"key", base64.StdEncoding.EncodeToString(session.PublicKey[:]),
+				"virtual_addr", session.Addr,
+			)
+		} else {
+			kv = append(kv, "client", clientIP(r))
+		}
+		kv = append(kv,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration", time.Since(start),
+			"user_agent", r.UserAgent(),
+		)
+
+		attrs.mu.Lock()
+		kv = append(kv, attrs.kv...)
+		attrs.mu.Unlock()
+
+		access.Info("request", kv...)
+	})
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+
+	"kraken/util"
+)
+
+const adminTokenEnv = "KRAKEN_ADMIN_TOKEN"
+
+// Load the bearer token guarding the admin API from filename or $KRAKEN_ADMIN_TOKEN.
+func loadAdminToken(filename string) (string, error) {
+	token := os.Getenv(adminTokenEnv)
+	if filename != "" {
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			return "", err
+		}
+		token = string(b)
+	}
+
+	token = strings.TrimSpace(token)
+	if len(token) < 16 {
+		return "", fmt.Errorf("admin token must be at least 16 characters")
+	}
+	return token, nil
+}
+
+// A live session as reported by the admin API.
+type sessionInfo struct {
+	ID            string     `json:"id"`
+	PublicKey     string     `json:"public_key"`
+	Addr          netip.Addr `json:"virtual_address"`
+	ClientIP      netip.Addr `json:"client_ip"`
+	Connected     time.Time  `json:"connected"`
+	RxBytes       uint64     `json:"rx_bytes"`
+	TxBytes       uint64     `json:"tx_bytes"`
+	LastHandshake *time.Time `json:"last_handshake,omitempty"`
+}
+
+// A ban on a key or client IP, as requested and listed by the admin API.
+type banInfo struct {
+	Key      string    `json:"key,omitempty"`
+	IP       string    `json:"ip,omitempty"`
+	Duration Duration  `json:"duration,omitempty"`
+	Until    time.Time `json:"until,omitempty"`
+}
+
+// Admin API, served on its own listener.
+func adminHandler(token string, reloader *Reloader, sessions *SessionTable, bans *BanList, dashboard *Dashboard) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		err := reloader.Reload()
+		if err != nil {
+			logger.Error("reload failed", "err", err)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		logger.Info("reloaded configuration")
+		io.WriteString(w, "reloaded\n")
+	})
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, listSessions(sessions))
+	})
+	mux.HandleFunc("/sessions/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", http.MethodDelete)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		id := strings.TrimPrefix(r.URL.Path, "/sessions/")
+		if sessions.Kick(func(s *Session) bool { return s.ID == id }, "disconnected by administrator") == 0 {
+			http.Error(w, "no such session", http.StatusNotFound)
+			return
+		}
+		logger.Info("admin disconnected session", "session", id)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/bans", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, listBans(bans))
+		case http.MethodPost, http.MethodDelete:
+			var req banInfo
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			err = updateBan(bans, sessions, req, r.Method == http.MethodDelete)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.Handle("/dashboard/events", dashboard.eventsHandler())
+	mux.Handle("/dashboard/", dashboard.pageHandler())
+
+	return adminAuthWrapper(token, mux)
+}
+
+// Require the admin token, as a bearer token or, so the dashboard works in a
+// browser, as a basic auth password.
+func adminAuthWrapper(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		given := strings.TrimPrefix(auth, "Bearer ")
+		if given == auth {
+			_, given, _ = r.BasicAuth()
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Add("WWW-Authenticate", `Bearer realm="kraken admin"`)
+			w.Header().Add("WWW-Authenticate", `Basic realm="kraken admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func listSessions(sessions *SessionTable) []sessionInfo {
+	handshakes := make(map[*Tunnel]map[device.NoisePublicKey]time.Time)
+	infos := []sessionInfo{}
+	for _, s := range sessions.Sessions() {
+		info := sessionInfo{
+			ID:        s.ID,
+			PublicKey: base64.StdEncoding.EncodeToString(s.PublicKey[:]),
+			Addr:      s.Addr,
+			ClientIP:  s.ClientIP,
+			Connected: s.Started,
+			RxBytes:   s.rxBytes.Load(),
+			TxBytes:   s.txBytes.Load(),
+		}
+
+		if _, ok := handshakes[s.tunnel]; !ok {
+			hs, err := lastHandshakes(s.tunnel.dev)
+			if err != nil {
+				logger.Error("reading device state", "err", err)
+			}
+			handshakes[s.tunnel] = hs
+		}
+		if t, ok := handshakes[s.tunnel][s.PublicKey]; ok {
+			info.LastHandshake = &t
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// Read each peer's last handshake time from the device.
+func lastHandshakes(dev *device.Device) (map[device.NoisePublicKey]time.Time, error) {
+	config, err := dev.IpcGet()
+	if err != nil {
+		return nil, err
+	}
+
+	handshakes := make(map[device.NoisePublicKey]time.Time)
+	var peer device.NoisePublicKey
+	var sec int64
+	scanner := bufio.NewScanner(strings.NewReader(config))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		switch key {
+		case "public_key":
+			err = peer.FromHex(value)
+			if err != nil {
+				return nil, err
+			}
+		case "last_handshake_time_sec":
+			sec, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+		case "last_handshake_time_nsec":
+			nsec, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			if sec != 0 || nsec != 0 {
+				handshakes[peer] = time.Unix(sec, nsec)
+			}
+		}
+	}
+	return handshakes, scanner.Err()
+}
+
+func listBans(bans *BanList) []banInfo {
+	keys, ips := bans.List()
+	infos := []banInfo{}
+	for key, until := range keys {
+		infos = append(infos, banInfo{Key: base64.StdEncoding.EncodeToString(key[:]), Until: until})
+	}
+	for ip, until := range ips {
+		infos = append(infos, banInfo{IP: ip.String(), Until: until})
+	}
+	return infos
+}
+
+// Add or lift a ban. New bans also disconnect matching sessions.
+func updateBan(bans *BanList, sessions *SessionTable, req banInfo, lift bool) error {
+	if (req.Key == "") == (req.IP == "") {
+		return fmt.Errorf("exactly one of key and ip is required")
+	}
+	if !lift && req.Duration <= 0 {
+		return fmt.Errorf("duration must be positive")
+	}
+	until := time.Now().Add(time.Duration(req.Duration))
+
+	if req.Key != "" {
+		b, err := util.ParseKey(req.Key)
+		if err != nil {
+			return err
+		}
+		var key device.NoisePublicKey
+		copy(key[:], b)
+
+		if lift {
+			bans.UnbanKey(key)
+			logger.Info("admin lifted ban", "key", req.Key)
+			return nil
+		}
+		bans.BanKey(key, until)
+		n := sessions.Kick(func(s *Session) bool { return s.PublicKey == key }, "banned")
+		logger.Info("admin banned key", "key", req.Key, "until", until, "disconnected", n)
+		return nil
+	}
+
+	ip, err := netip.ParseAddr(req.IP)
+	if err != nil {
+		return err
+	}
+	if lift {
+		bans.UnbanIP(ip)
+		logger.Info("admin lifted ban", "ip", ip)
+		return nil
+	}
+	bans.BanIP(ip, until)
+	n := sessions.Kick(func(s *Session) bool { return s.ClientIP.Unmap() == ip.Unmap() }, "banned")
+	logger.Info("admin banned ip", "ip", ip, "until", until, "disconnected", n)
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// The hash preceding the first entry.
+var auditGenesis = hex.EncodeToString(make([]byte, sha256.Size))
+
+// One attempt to read a private file. Hash covers Prev and every other field,
+// so editing, reordering or removing an entry breaks the chain after it.
+type AuditEntry struct {
+	Seq         uint64    `json:"seq"`
+	Time        time.Time `json:"time"`
+	Key         string    `json:"key,omitempty"`
+	VirtualAddr string    `json:"virtual_addr"`
+	Client      string    `json:"client,omitempty"`
+	Path        string    `json:"path"`
+	Decision    string    `json:"decision"`
+	Status      int       `json:"status"`
+	Bytes       int       `json:"bytes"`
+	Prev        string    `json:"prev"`
+	Hash        string    `json:"hash,omitempty"`
+}
+
+func (e AuditEntry) computeHash() string {
+	e.Hash = ""
+	b, _ := json.Marshal(e)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Appends hash-chained entries to the audit log file.
+type AuditLog struct {
+	mu   sync.Mutex // protects following fields
+	f    *os.File
+	seq  uint64
+	prev string
+}
+
+// Open filename for appending, continuing the chain already in it. A file
+// whose chain doesn't verify is refused rather than extended, so tampering
+// can't be hidden behind fresh valid entries. Returns nil if filename is
+// empty.
+func openAuditLog(filename string) (*AuditLog, error) {
+	if filename == "" {
+		return nil, nil
+	}
+
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, err
+	}
+
+	seq, prev, err := verifyAuditLog(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v; move it aside to start a new log", filename, err)
+	}
+	return &AuditLog{f: f, seq: seq, prev: prev}, nil
+}
+
+func (a *AuditLog) Append(e AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	e.Seq = a.seq + 1
+	e.Prev = a.prev
+	e.Hash = e.computeHash()
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = a.f.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+	err = a.f.Sync()
+	if err != nil {
+		return err
+	}
+	a.seq, a.prev = e.Seq, e.Hash
+	return nil
+}
+
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.f.Close()
+}
+
+// Check the chain in r. Returns the number of entries and the last hash, which
+// should be kept elsewhere to also detect entries cut from the end.
+func verifyAuditLog(r io.Reader) (uint64, string, error) {
+	prev := auditGenesis
+	var seq uint64
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := seq + 1
+		var e AuditEntry
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			return seq, prev, fmt.Errorf("entry %d: %v", line, err)
+		}
+		if e.Seq != line {
+			return seq, prev, fmt.Errorf("entry %d: sequence number %d out of order", line, e.Seq)
+		}
+		if e.Prev != prev {
+			return seq, prev, fmt.Errorf("entry %d: does not follow entry %d", line, seq)
+		}
+		if e.Hash != e.computeHash() {
+			return seq, prev, fmt.Errorf("entry %d: hash mismatch, entry was modified", line)
+		}
+		seq, prev = e.Seq, e.Hash
+	}
+	return seq, prev, scanner.Err()
+}
+
+// The verify-audit subcommand.
+func verifyAuditCommand(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: server verify-audit <file>")
+		return 2
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+
+	n, last, err := verifyAuditLog(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		return 1
+	}
+	fmt.Printf("%s: %d entries ok, last hash %s\n", args[0], n, last)
+	return 0
+}
+
+// Record every request under /private/, allowed or not.
+func auditWrapper(audit *AuditLog, h http.Handler) http.Handler {
+	if audit == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		e := AuditEntry{
+			Time:     time.Now().UTC(),
+			Path:     r.URL.Path,
+			Decision: "allow",
+			Status:   rec.status,
+			Bytes:    rec.bytes,
+		}
+		if rec.status == http.StatusForbidden {
+			e.Decision = "deny"
+		}
+		if addr, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+			e.VirtualAddr = addr.Addr().String()
+		}
+		// traceWrapper found the session by source address. Sessions are
+		// only registered once they have proven their key, one per address,
+		// and WireGuard drops packets whose source the sending peer doesn't
+		// own, so the address identifies the key.
+		if s := sessionFromContext(r.Context()); s != nil {
+			e.Key = base64.StdEncoding.EncodeToString(s.PublicKey[:])
+			e.Client = s.ClientIP.String()
+		}
+
+		err := audit.Append(e)
+		if err != nil {
+			logger.Error("writing audit log", "err", err)
+		}
+	})
+}
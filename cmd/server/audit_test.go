@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Editing any entry must be reported at that entry, with the entries before it
+// still counted as intact.
+func TestVerifyAuditLogFindsEditedEntry(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := openAuditLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/private/a.jpg", "/private/b.jpg", "/private/c.jpg"} {
+		err = audit.Append(AuditEntry{Path: path, Decision: "deny", Status: http.StatusForbidden})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	audit.Close()
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _, err := verifyAuditLog(bytes.NewReader(b))
+	if err != nil || n != 3 {
+		t.Fatalf("untouched log: got %d entries, %v", n, err)
+	}
+
+	lines := strings.SplitAfter(string(b), "\n")
+	var e AuditEntry
+	err = json.Unmarshal([]byte(lines[1]), &e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Decision = "allow"
+	e.Status = http.StatusOK
+	edited, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines[1] = string(edited) + "\n"
+
+	n, _, err = verifyAuditLog(strings.NewReader(strings.Join(lines, "")))
+	if err == nil || !strings.HasPrefix(err.Error(), "entry 2:") {
+		t.Errorf("edited log: got %v, want an error for entry 2", err)
+	}
+	if n != 1 {
+		t.Errorf("edited log: got %d intact entries, want 1", n)
+	}
+
+	err = os.WriteFile(filename, []byte(strings.Join(lines, "")), 0o640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = openAuditLog(filename)
+	if err == nil || !strings.Contains(err.Error(), "entry 2:") {
+		t.Errorf("opening edited log: got %v, want an error for entry 2", err)
+	}
+}
+
+// Entries name the key of the verified session that owns the source address,
+// and nobody else.
+func TestAuditAttributesSessionByAddress(t *testing.T) {
+	sessions := NewSessionTable()
+	owner := &Session{ID: "owner", Addr: netip.MustParseAddr("10.0.0.2"), ClientIP: netip.MustParseAddr("203.0.113.7")}
+	owner.PublicKey[0] = 1
+	err := sessions.Add(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.Remove(owner)
+
+	claimant := &Session{ID: "claimant", Addr: netip.MustParseAddr("::ffff:10.0.0.2")}
+	if err := sessions.Add(claimant); err != errAddrInUse {
+		t.Errorf("second session for the same address: got %v, want %v", err, errAddrInUse)
+	}
+	sharer := &Session{ID: "sharer", Addr: netip.MustParseAddr("10.0.0.4"), PublicKey: owner.PublicKey}
+	if err := sessions.Add(sharer); err != errKeyInUse {
+		t.Errorf("second session for the same key: got %v, want %v", err, errKeyInUse)
+	}
+
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := openAuditLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	forbid := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	})
+	h := traceWrapper(sessions, auditWrapper(audit, forbid))
+	for _, remote := range []string{"10.0.0.2:1234", "10.0.0.3:1234"} {
+		r := httptest.NewRequest("GET", "/private/flag.jpg", nil)
+		r.RemoteAddr = remote
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []AuditEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var e AuditEntry
+		err = json.Unmarshal([]byte(line), &e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	if entries[0].Key != "AQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=" || entries[0].Client != "203.0.113.7" {
+		t.Errorf("owner's request attributed to key %q, client %q", entries[0].Key, entries[0].Client)
+	}
+	if entries[1].Key != "" || entries[1].Client != "" {
+		t.Errorf("unowned address attributed to key %q, client %q", entries[1].Key, entries[1].Client)
+	}
+}
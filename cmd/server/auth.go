@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	authCookie = "kraken_auth"
+
+	// How long the cookie set after logging in to the index page lasts.
+	authCookieTTL = 12 * time.Hour
+
+	inviteLabel       = "kraken invite v1"
+	authCookieLabel   = "kraken auth cookie v1"
+	minInviteKeyBytes = 16
+)
+
+// Signs the cookies handed out after a successful login. Restarting the
+// server logs everyone out.
+var authCookieKey = func() []byte {
+	key := make([]byte, 32)
+	randomID(key)
+	return key
+}()
+
+// Credentials accepted on /ws and the index page. A nil Auth lets everyone in.
+type Auth struct {
+	tokens    []string          // static bearer tokens
+	inviteKey []byte            // signs invite links, nil if disabled
+	users     map[string]string // htpasswd user to password hash
+}
+
+// Load whichever credential sources cfg names. Returns nil if none.
+func loadAuth(cfg *Config) (*Auth, error) {
+	if cfg.AuthTokensFile == "" && cfg.InviteKeyFile == "" && cfg.HtpasswdFile == "" {
+		return nil, nil
+	}
+
+	a := &Auth{}
+	if cfg.AuthTokensFile != "" {
+		lines, err := readLines(cfg.AuthTokensFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			if len(line) < 16 {
+				return nil, fmt.Errorf("%s: tokens must be at least 16 characters", cfg.AuthTokensFile)
+			}
+			a.tokens = append(a.tokens, line)
+		}
+	}
+	if cfg.InviteKeyFile != "" {
+		key, err := loadInviteKey(cfg.InviteKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		a.inviteKey = key
+	}
+	if cfg.HtpasswdFile != "" {
+		users, err := loadHtpasswd(cfg.HtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		a.users = users
+	}
+	return a, nil
+}
+
+// Non-empty lines of filename with # comments removed.
+func readLines(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+func loadInviteKey(filename string) ([]byte, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key := []byte(strings.TrimSpace(string(b)))
+	if len(key) < minInviteKeyBytes {
+		return nil, fmt.Errorf("%s: invite key must be at least %d characters", filename, minInviteKeyBytes)
+	}
+	return key, nil
+}
+
+// Read user:hash lines as written by htpasswd -B (bcrypt) or -s ({SHA}).
+func loadHtpasswd(filename string) (map[string]string, error) {
+	lines, err := readLines(filename)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]string)
+	for _, line := range lines {
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s: expected user:hash", filename)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("%s: user %s: only bcrypt and {SHA} hashes are supported", filename, user)
+		}
+		users[user] = hash
+	}
+	return users, nil
+}
+
+func (a *Auth) checkPassword(user, password string) bool {
+	hash, ok := a.users[user]
+	if !ok {
+		return false
+	}
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hash[len("{SHA}"):]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// Check a bearer token, static or invite, returning how it authenticated.
+func (a *Auth) checkToken(token string) (string, string, time.Time, bool) {
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return "token", "", time.Time{}, true
+		}
+	}
+	if a.inviteKey != nil {
+		if name, expiry, ok := verifyTicket(a.inviteKey, inviteLabel, token); ok {
+			return "invite", name, expiry, true
+		}
+	}
+	return "", "", time.Time{}, false
+}
+
+// Who r is, from an Authorization header, a token query parameter or the
+// login cookie. expiry bounds how long a cookie for it may last, zero if it
+// doesn't expire.
+func (a *Auth) Authenticate(r *http.Request) (method, user string, expiry time.Time, ok bool) {
+	if name, expiry, ok := verifyTicket(authCookieKey, authCookieLabel, cookieValue(r)); ok {
+		return "cookie", name, expiry, true
+	}
+	if token := r.URL.Query().Get("token"); token != "" {
+		return a.checkToken(token)
+	}
+	if token := r.URL.Query().Get("invite"); token != "" {
+		return a.checkToken(token)
+	}
+	if user, password, ok := r.BasicAuth(); ok {
+		return "basic", user, time.Time{}, a.checkPassword(user, password)
+	}
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return a.checkToken(strings.TrimPrefix(header, "Bearer "))
+	}
+	return "", "", time.Time{}, false
+}
+
+func cookieValue(r *http.Request) string {
+	c, err := r.Cookie(authCookie)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+// Whether r carries credentials other than the login cookie, so a browser's
+// first unauthenticated request isn't held against it.
+func presentsCredentials(r *http.Request) bool {
+	query := r.URL.Query()
+	return query.Get("token") != "" || query.Get("invite") != "" || r.Header.Get("Authorization") != ""
+}
+
+// Let through only requests with valid credentials. Logging in to the index
+// page sets a cookie so the wasm client's /ws requests are let through too.
+// Failed logins count towards limiter like failed handshakes.
+func authWrapper(reloader *Reloader, limiter *failureLimiter, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := reloader.State().Auth
+		if auth == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if !limiter.Allow(clientIP(r)) {
+			logger.Info("rejected client after too many failed attempts", "client", clientIP(r), "path", r.URL.Path)
+			http.Error(w, "too many failed attempts", http.StatusTooManyRequests)
+			return
+		}
+
+		method, user, expiry, ok := auth.Authenticate(r)
+		if !ok {
+			authFailures.Inc()
+			if presentsCredentials(r) {
+				limiter.Fail(clientIP(r))
+			}
+			logger.Info("rejected unauthenticated request", "client", clientIP(r), "path", r.URL.Path)
+			if auth.users != nil {
+				w.Header().Set("WWW-Authenticate", `Basic realm="kraken", charset="UTF-8"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="kraken"`)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		addAccessAttrs(r, "auth", method, "user", user)
+
+		if method != "cookie" {
+			cookieExpiry := time.Now().Add(authCookieTTL)
+			if !expiry.IsZero() && expiry.Before(cookieExpiry) {
+				cookieExpiry = expiry
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     authCookie,
+				Value:    signTicket(authCookieKey, authCookieLabel, user, cookieExpiry),
+				Path:     "/",
+				Expires:  cookieExpiry,
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// A ticket is name.expiry.mac, with the MAC over label, name and expiry.
+func signTicket(key []byte, label, name string, expiry time.Time) string {
+	payload := name + "." + strconv.FormatInt(expiry.Unix(), 10)
+	return payload + "." + ticketMAC(key, label, payload)
+}
+
+func ticketMAC(key []byte, label, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	mac.Write([]byte{0})
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Check a ticket's MAC and expiry, returning its name.
+func verifyTicket(key []byte, label, ticket string) (string, time.Time, bool) {
+	i := strings.LastIndexByte(ticket, '.')
+	if i < 0 {
+		return "", time.Time{}, false
+	}
+	payload, mac := ticket[:i], ticket[i+1:]
+	if !hmac.Equal([]byte(mac), []byte(ticketMAC(key, label, payload))) {
+		return "", time.Time{}, false
+	}
+	j := strings.LastIndexByte(payload, '.')
+	if j < 0 {
+		return "", time.Time{}, false
+	}
+	unix, err := strconv.ParseInt(payload[j+1:], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	expiry := time.Unix(unix, 0)
+	if time.Now().After(expiry) {
+		return "", time.Time{}, false
+	}
+	return payload[:j], expiry, true
+}
+
+var errInviteName = errors.New("invite name may only use letters, digits, - and _")
+
+// The invite subcommand prints a signed, expiring invite link.
+func inviteCommand(args []string) int {
+	fs := flag.NewFlagSet("invite", flag.ContinueOnError)
+	keyFile := fs.String("invite-key-file", os.Getenv(envName("invite-key-file")), "file holding the invite signing key (default $"+envName("invite-key-file")+")")
+	name := fs.String("name", "guest", "who the invite is for, shown in logs")
+	ttl := fs.Duration("ttl", 24*time.Hour, "how long the invite is valid")
+	base := fs.String("url", "http://localhost/", "address of the index page")
+	err := fs.Parse(args)
+	if err != nil {
+		return 2
+	}
+
+	for _, c := range *name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			fmt.Fprintln(os.Stderr, errInviteName)
+			return 2
+		}
+	}
+	if *keyFile == "" {
+		fmt.Fprintln(os.Stderr, "-invite-key-file is required")
+		return 2
+	}
+	key, err := loadInviteKey(*keyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	u, err := url.Parse(*base)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	q := u.Query()
+	q.Set("invite", signTicket(key, inviteLabel, *name, time.Now().Add(*ttl)))
+	u.RawQuery = q.Encode()
+	fmt.Println(u)
+	return 0
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyTicket(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	valid := signTicket(key, inviteLabel, "alice", expiry)
+	name, exp := valid[:strings.IndexByte(valid, '.')], strconv.FormatInt(expiry.Unix(), 10)
+	mac := valid[strings.LastIndexByte(valid, '.')+1:]
+
+	got, gotExpiry, ok := verifyTicket(key, inviteLabel, valid)
+	if !ok || got != "alice" || !gotExpiry.Equal(expiry) {
+		t.Errorf("valid ticket: got %q expiring %v, %v", got, gotExpiry, ok)
+	}
+
+	tests := []struct {
+		name   string
+		key    []byte
+		label  string
+		ticket string
+		ok     bool
+	}{
+		{"valid", key, inviteLabel, valid, true},
+		{"name with dots", key, inviteLabel, signTicket(key, inviteLabel, "a.b", expiry), true},
+		{"expired", key, inviteLabel, signTicket(key, inviteLabel, "alice", time.Now().Add(-time.Second)), false},
+		{"other key", []byte("fedcba9876543210fedcba9876543210"), inviteLabel, valid, false},
+		{"other label", key, authCookieLabel, valid, false},
+		{"renamed", key, inviteLabel, "mallory." + exp + "." + mac, false},
+		{"extended", key, inviteLabel, name + "." + strconv.FormatInt(expiry.Add(time.Hour).Unix(), 10) + "." + mac, false},
+		{"no mac", key, inviteLabel, name + "." + exp, false},
+		{"no dots", key, inviteLabel, "alice", false},
+		{"empty", key, inviteLabel, "", false},
+	}
+	for _, tt := range tests {
+		_, _, ok := verifyTicket(tt.key, tt.label, tt.ticket)
+		if ok != tt.ok {
+			t.Errorf("%s: got ok %v, want %v", tt.name, ok, tt.ok)
+		}
+	}
+}
+
+// Wrong credentials count towards the failure limit, and once it is reached
+// even the right ones are refused until the window passes.
+func TestAuthLimitsFailedLogins(t *testing.T) {
+	reloader := &Reloader{}
+	reloader.state.Store(&State{Auth: &Auth{tokens: []string{"correct-horse-battery"}}})
+	h := authWrapper(reloader, newFailureLimiter(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	login := func(token string) int {
+		r := httptest.NewRequest("GET", "/", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for i := 0; i < maxProofFailures+1; i++ {
+		if code := login(""); code != http.StatusUnauthorized {
+			t.Fatalf("request without credentials: got %d, want %d", code, http.StatusUnauthorized)
+		}
+	}
+	for i := 0; i < maxProofFailures; i++ {
+		if code := login("wrong"); code != http.StatusUnauthorized {
+			t.Fatalf("failed login %d: got %d, want %d", i+1, code, http.StatusUnauthorized)
+		}
+	}
+	if code := login("correct-horse-battery"); code != http.StatusTooManyRequests {
+		t.Errorf("login after %d failures: got %d, want %d", maxProofFailures, code, http.StatusTooManyRequests)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// Keys and client IPs refused until their ban expires. Bans are kept in
+// memory and forgotten on restart.
+type BanList struct {
+	mu   sync.Mutex // protects following fields
+	keys map[device.NoisePublicKey]time.Time
+	ips  map[netip.Addr]time.Time
+}
+
+func NewBanList() *BanList {
+	return &BanList{
+		keys: make(map[device.NoisePublicKey]time.Time),
+		ips:  make(map[netip.Addr]time.Time),
+	}
+}
+
+func (b *BanList) BanKey(key device.NoisePublicKey, until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.keys[key] = until
+}
+
+// IPv4-mapped addresses are stored unmapped, so a ban matches either form.
+func (b *BanList) BanIP(ip netip.Addr, until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.ips[ip.Unmap()] = until
+}
+
+func (b *BanList) UnbanKey(key device.NoisePublicKey) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.keys, key)
+}
+
+func (b *BanList) UnbanIP(ip netip.Addr) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.ips, ip.Unmap())
+}
+
+func (b *BanList) KeyBanned(key device.NoisePublicKey) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expire()
+	_, ok := b.keys[key]
+	return ok
+}
+
+func (b *BanList) IPBanned(ip netip.Addr) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expire()
+	_, ok := b.ips[ip.Unmap()]
+	return ok
+}
+
+// Snapshot of live bans.
+func (b *BanList) List() (map[device.NoisePublicKey]time.Time, map[netip.Addr]time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expire()
+	keys := make(map[device.NoisePublicKey]time.Time, len(b.keys))
+	for k, until := range b.keys {
+		keys[k] = until
+	}
+	ips := make(map[netip.Addr]time.Time, len(b.ips))
+	for ip, until := range b.ips {
+		ips[ip] = until
+	}
+	return keys, ips
+}
+
+// Drop expired bans. Callers hold mu.
+func (b *BanList) expire() {
+	now := time.Now()
+	for k, until := range b.keys {
+		if now.After(until) {
+			delete(b.keys, k)
+		}
+	}
+	for ip, until := range b.ips {
+		if now.After(until) {
+			delete(b.ips, ip.Unmap())
+		}
+	}
+}
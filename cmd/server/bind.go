@@ -11,21 +11,26 @@ import (
 	"golang.zx2c4.com/wireguard/conn"
 )
 
+// Datagrams queued per session before Send starts dropping.
+const sendQueueLen = 64
+
 type WSMessage struct {
-	buff     []byte
+	buff     []byte // owned by the bind once sent
 	endpoint WSEndpoint
 	response WSResponse
 }
 
 type WSResponse struct {
-	data chan []byte
-	ctx  context.Context
+	data    chan []byte
+	ctx     context.Context
+	session *Session // nil for internal probes
 }
 
 type WSBind struct {
 	mu            sync.RWMutex // protects following fields
 	messageChan   chan WSMessage
 	responseChans map[WSEndpoint]WSResponse
+	closed        chan struct{}
 }
 
 func NewWSBind(wsChan chan WSMessage) conn.Bind {
@@ -72,24 +77,57 @@ func (e WSEndpoint) SrcToString() string {
 }
 
 func (bind *WSBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
-	return []conn.ReceiveFunc{bind.makeReceiveWS()}, port, nil
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+
+	bind.closed = make(chan struct{})
+	return []conn.ReceiveFunc{bind.makeReceiveWS(bind.closed)}, port, nil
 }
 
+// Close unblocks receivers so the device can go down.
 func (bind *WSBind) Close() error {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+
+	if bind.closed != nil {
+		close(bind.closed)
+		bind.closed = nil
+	}
 	return nil
 }
 
-func (bind *WSBind) makeReceiveWS() conn.ReceiveFunc {
+func (bind *WSBind) makeReceiveWS(closed chan struct{}) conn.ReceiveFunc {
 	return func(buff []byte) (int, conn.Endpoint, error) {
-
-		msg := <-bind.messageChan
-
-		bind.mu.Lock()
-		bind.responseChans[msg.endpoint] = msg.response
-		bind.mu.Unlock()
-
-		copy(buff, msg.buff)
-		return len(msg.buff), msg.endpoint, nil
+		for {
+			var msg WSMessage
+			select {
+			case msg = <-bind.messageChan:
+			case <-closed:
+				return 0, nil, net.ErrClosed
+			}
+
+			session := msg.response.session
+			if session != nil && !session.up.Allow(len(msg.buff)) {
+				bindShapedDrops.Inc("rx")
+				continue
+			}
+
+			bind.mu.Lock()
+			bind.responseChans[msg.endpoint] = msg.response
+			bind.mu.Unlock()
+
+			if session != nil {
+				if session.firstRx != nil {
+					session.firstRx.End()
+				}
+				session.charge(len(msg.buff))
+			}
+
+			n := copy(buff, msg.buff)
+			bindDatagrams.Inc("rx")
+			bindBytes.Add(float64(n), "rx")
+			return n, msg.endpoint, nil
+		}
 	}
 }
 
@@ -107,11 +145,29 @@ func (bind *WSBind) Send(buff []byte, endpoint conn.Endpoint) error {
 	}
 
 	select {
-	case response.data <- buff:
 	case <-response.ctx.Done():
 		return net.ErrClosed
+	default:
+	}
+
+	session := response.session
+	if session != nil && !session.down.Allow(len(buff)) {
+		bindShapedDrops.Inc("tx")
+		return nil
 	}
 
+	// The device reuses buff once Send returns, and a slow client must not
+	// stall the device, so queue a copy or drop it.
+	select {
+	case response.data <- append([]byte(nil), buff...):
+		bindDatagrams.Inc("tx")
+		bindBytes.Add(float64(len(buff)), "tx")
+		if session != nil {
+			session.charge(len(buff))
+		}
+	default:
+		bindSendDrops.Inc()
+	}
 	return nil
 }
 
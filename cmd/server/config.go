@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"kraken/assets"
+	"kraken/util"
+)
+
+const configEnv = "KRAKEN_CONFIG"
+
+// Server settings. Each one can be given, from highest to lowest precedence,
+// as a flag (-assets-dir), an environment variable (KRAKEN_ASSETS_DIR) or a
+// key in the JSON config file named by -config or $KRAKEN_CONFIG
+// ("assets_dir"). Anything left unset keeps its default.
+type Config struct {
+	Listen           string   `json:"listen"`
+	AssetsDir        string   `json:"assets_dir"`
+	CompressedDir    string   `json:"compressed_dir"`
+	PrivateDir       string   `json:"private_dir"`
+	VirtualAddress   string   `json:"virtual_address"`
+	VirtualPort      int      `json:"virtual_port"`
+	MTU              int      `json:"mtu"`
+	SessionTimeout   Duration `json:"session_timeout"`
+	HandshakeTimeout Duration `json:"handshake_timeout"`
+	DrainTimeout     Duration `json:"drain_timeout"`
+	LogLevel         string   `json:"log_level"`
+	LogFormat        string   `json:"log_format"`
+	KeyFile          string   `json:"key_file"`
+	SigningKeyFile   string   `json:"signing_key_file"`
+	PresharedKeyFile string   `json:"preshared_key_file"`
+	PeersFile        string   `json:"peers"`
+	AdminListen      string   `json:"admin_listen"`
+	AdminTokenFile   string   `json:"admin_token_file"`
+	TraceFile        string   `json:"trace_file"`
+	TrustedProxies   string   `json:"trusted_proxies"`
+	AccessLog        string   `json:"access_log"`
+	AuditLog         string   `json:"audit_log"`
+
+	MaxSessions        int `json:"max_sessions"`
+	MaxSessionsPerIP   int `json:"max_sessions_per_ip"`
+	SessionRate        int `json:"session_rate"`
+	SessionRatePerIP   int `json:"session_rate_per_ip"`
+	HandshakeRate      int `json:"handshake_rate"`
+	HandshakeRatePerIP int `json:"handshake_rate_per_ip"`
+
+	BandwidthUp   int    `json:"bandwidth_up"`
+	BandwidthDown int    `json:"bandwidth_down"`
+	QuotaPerKey   uint64 `json:"quota_per_key"`
+	QuotaPerIP    uint64 `json:"quota_per_ip"`
+	QuotaFile     string `json:"quota_file"`
+
+	PuzzleTarget Duration `json:"puzzle_target"`
+
+	AuthTokensFile string `json:"auth_tokens_file"`
+	InviteKeyFile  string `json:"invite_key_file"`
+	HtpasswdFile   string `json:"htpasswd_file"`
+
+	AllowedOrigins string `json:"allowed_origins"`
+	AllowedHosts   string `json:"allowed_hosts"`
+	Dev            bool   `json:"dev"`
+
+	TLSCertFile   string   `json:"tls_cert_file"`
+	TLSKeyFile    string   `json:"tls_key_file"`
+	TLSSelfSigned bool     `json:"tls_self_signed"`
+	HSTS          Duration `json:"hsts"`
+}
+
+// A time.Duration written as "10s" in flags, environment and config files.
+type Duration time.Duration
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	*d = Duration(v)
+	return err
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:             fmt.Sprintf(":%v", util.ServerPhysicalPort),
+		VirtualAddress:     util.ServerVirtualAddress,
+		VirtualPort:        util.ServerVirtualPort,
+		MTU:                util.MTU,
+		SessionTimeout:     Duration(10 * time.Second),
+		HandshakeTimeout:   Duration(5 * time.Second),
+		DrainTimeout:       Duration(15 * time.Second),
+		LogLevel:           "info",
+		LogFormat:          "text",
+		MaxSessions:        512,
+		MaxSessionsPerIP:   8,
+		SessionRatePerIP:   30,
+		HandshakeRatePerIP: 60,
+	}
+}
+
+func (c *Config) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.StringVar(&c.Listen, "listen", c.Listen, "address of the physical HTTP server")
+	fs.StringVar(&c.AssetsDir, "assets-dir", c.AssetsDir, "directory holding index.html and the gallery, embedded copies if empty")
+	fs.StringVar(&c.CompressedDir, "compressed-dir", c.CompressedDir, "directory holding gzipped static assets, embedded copies if empty")
+	fs.StringVar(&c.PrivateDir, "private-dir", c.PrivateDir, "directory holding the private gallery, gallery/priv under -assets-dir if empty")
+	fs.StringVar(&c.VirtualAddress, "virtual-address", c.VirtualAddress, "address of the virtual file server")
+	fs.IntVar(&c.VirtualPort, "virtual-port", c.VirtualPort, "port of the virtual file server")
+	fs.IntVar(&c.MTU, "mtu", c.MTU, "MTU of the virtual network")
+	fs.Var(&c.SessionTimeout, "session-timeout", "maximum lifetime of a websocket session")
+	fs.Var(&c.HandshakeTimeout, "handshake-timeout", "time allowed for each step of the websocket handshake")
+	fs.Var(&c.DrainTimeout, "drain-timeout", "time live sessions get to finish on shutdown")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "log level: debug, info, warn or error")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log format: text or json")
+	fs.StringVar(&c.KeyFile, "key-file", c.KeyFile, "file holding base64 server private keys, preferred first (default $"+privateKeysEnv+")")
+	fs.StringVar(&c.SigningKeyFile, "signing-key-file", c.SigningKeyFile, "file holding the base64 ed25519 seed that signs discovery documents (default $"+signingKeyEnv+")")
+	fs.StringVar(&c.PresharedKeyFile, "preshared-key-file", c.PresharedKeyFile, "file holding a base64 preshared key for ephemeral peers")
+	fs.StringVar(&c.PeersFile, "peers", c.PeersFile, "file declaring registered peers and access rules")
+	fs.StringVar(&c.AdminListen, "admin-listen", c.AdminListen, "address of the admin API, disabled if empty")
+	fs.StringVar(&c.AdminTokenFile, "admin-token-file", c.AdminTokenFile, "file holding the admin API bearer token (default $"+adminTokenEnv+")")
+	fs.StringVar(&c.TraceFile, "trace-file", c.TraceFile, "file to append OTLP-JSON spans to, disabled if empty")
+	fs.StringVar(&c.TrustedProxies, "trusted-proxies", c.TrustedProxies, "comma separated addresses or prefixes of proxies trusted to set X-Forwarded-For and X-Real-IP")
+	fs.StringVar(&c.AccessLog, "access-log", c.AccessLog, "file to append access log lines to, - for stdout, disabled if empty")
+	fs.StringVar(&c.AuditLog, "audit-log", c.AuditLog, "file to append the hash-chained private access audit log to, disabled if empty")
+	fs.IntVar(&c.MaxSessions, "max-sessions", c.MaxSessions, "concurrent websocket sessions, 0 for unlimited")
+	fs.IntVar(&c.MaxSessionsPerIP, "max-sessions-per-ip", c.MaxSessionsPerIP, "concurrent websocket sessions from one client address, 0 for unlimited")
+	fs.IntVar(&c.SessionRate, "session-rate", c.SessionRate, "new websocket sessions per minute, 0 for unlimited")
+	fs.IntVar(&c.SessionRatePerIP, "session-rate-per-ip", c.SessionRatePerIP, "new websocket sessions per minute from one client address, 0 for unlimited")
+	fs.IntVar(&c.HandshakeRate, "handshake-rate", c.HandshakeRate, "websocket handshake attempts per minute, 0 for unlimited")
+	fs.IntVar(&c.HandshakeRatePerIP, "handshake-rate-per-ip", c.HandshakeRatePerIP, "websocket handshake attempts per minute from one client address, 0 for unlimited")
+	fs.IntVar(&c.BandwidthUp, "bandwidth-up", c.BandwidthUp, "bytes per second each session may send, 0 for unlimited")
+	fs.IntVar(&c.BandwidthDown, "bandwidth-down", c.BandwidthDown, "bytes per second each session may receive, 0 for unlimited")
+	fs.Uint64Var(&c.QuotaPerKey, "quota-per-key", c.QuotaPerKey, "bytes each peer key may transfer per UTC day, 0 for unlimited")
+	fs.Uint64Var(&c.QuotaPerIP, "quota-per-ip", c.QuotaPerIP, "bytes each client address may transfer per UTC day, 0 for unlimited")
+	fs.StringVar(&c.QuotaFile, "quota-file", c.QuotaFile, "file keeping quota usage across restarts, in memory only if empty")
+	fs.Var(&c.PuzzleTarget, "puzzle-target", "time a slow client should take on the admission puzzle for anonymous peers when idle, disabled if 0")
+	fs.StringVar(&c.AuthTokensFile, "auth-tokens-file", c.AuthTokensFile, "file of bearer tokens accepted on /ws and the index page, one per line")
+	fs.StringVar(&c.InviteKeyFile, "invite-key-file", c.InviteKeyFile, "file holding the key that signs invite links")
+	fs.StringVar(&c.HtpasswdFile, "htpasswd-file", c.HtpasswdFile, "htpasswd file of users allowed on /ws and the index page, bcrypt or {SHA}")
+	fs.StringVar(&c.AllowedOrigins, "allowed-origins", c.AllowedOrigins, "comma separated origins, besides the server's own, whose pages may open /ws, such as https://*.example.com")
+	fs.StringVar(&c.AllowedHosts, "allowed-hosts", c.AllowedHosts, "comma separated host names /ws may be reached under, any if empty")
+	fs.BoolVar(&c.Dev, "dev", c.Dev, "development mode: also allow localhost origins and hosts on /ws")
+	fs.StringVar(&c.TLSCertFile, "tls-cert-file", c.TLSCertFile, "PEM certificate chain for serving HTTPS on -listen, reloaded when it changes")
+	fs.StringVar(&c.TLSKeyFile, "tls-key-file", c.TLSKeyFile, "PEM private key for -tls-cert-file")
+	fs.BoolVar(&c.TLSSelfSigned, "tls-self-signed", c.TLSSelfSigned, "serve HTTPS with a self-signed certificate for local use, kept in -tls-cert-file and -tls-key-file if set")
+	fs.Var(&c.HSTS, "hsts", "max-age of the Strict-Transport-Security header sent over TLS, disabled if 0")
+	return fs
+}
+
+// Environment variable overriding the setting behind flag name.
+func envName(name string) string {
+	return "KRAKEN_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Build the configuration from defaults, config file, environment and args.
+// Reports whether -check was given.
+func loadConfig(args []string) (*Config, bool, error) {
+	// First pass only finds the config file and -check.
+	c := defaultConfig()
+	fs := c.flagSet()
+	configFile := fs.String("config", os.Getenv(configEnv), "JSON config file (default $"+configEnv+")")
+	check := fs.Bool("check", false, "validate the configuration and exit")
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, false, err
+	}
+	if fs.NArg() > 0 {
+		return nil, false, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	c = defaultConfig()
+	if *configFile != "" {
+		f, err := os.Open(*configFile)
+		if err != nil {
+			return nil, false, err
+		}
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+		f.Close()
+		if err != nil {
+			return nil, false, fmt.Errorf("%s: %v", *configFile, err)
+		}
+	}
+
+	fs = c.flagSet()
+	fs.VisitAll(func(f *flag.Flag) {
+		if value, ok := os.LookupEnv(envName(f.Name)); ok && err == nil {
+			err = f.Value.Set(value)
+			if err != nil {
+				err = fmt.Errorf("%s: %v", envName(f.Name), err)
+			}
+		}
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	fs.String("config", "", "")
+	fs.Bool("check", false, "")
+	fs.SetOutput(io.Discard)
+	err = fs.Parse(args)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return c, *check, c.validate()
+}
+
+func (c *Config) validate() error {
+	_, _, err := net.SplitHostPort(c.Listen)
+	if err != nil {
+		return fmt.Errorf("listen: %v", err)
+	}
+	if c.AdminListen != "" {
+		_, _, err = net.SplitHostPort(c.AdminListen)
+		if err != nil {
+			return fmt.Errorf("admin listen: %v", err)
+		}
+	}
+	_, err = netip.ParseAddr(c.VirtualAddress)
+	if err != nil {
+		return fmt.Errorf("virtual address: %v", err)
+	}
+	if c.VirtualPort <= 0 || c.VirtualPort > 65535 {
+		return fmt.Errorf("virtual port %d out of range", c.VirtualPort)
+	}
+	if c.MTU < 1280 {
+		return fmt.Errorf("mtu %d is below the IPv6 minimum of 1280", c.MTU)
+	}
+	if c.SessionTimeout <= 0 || c.HandshakeTimeout <= 0 || c.DrainTimeout <= 0 {
+		return errors.New("timeouts must be positive")
+	}
+	for _, limit := range []int{c.MaxSessions, c.MaxSessionsPerIP, c.SessionRate, c.SessionRatePerIP, c.HandshakeRate, c.HandshakeRatePerIP} {
+		if limit < 0 {
+			return errors.New("session limits must not be negative")
+		}
+	}
+	if c.PuzzleTarget < 0 {
+		return errors.New("puzzle target must not be negative")
+	}
+	if c.HSTS < 0 {
+		return errors.New("hsts max-age must not be negative")
+	}
+	if c.BandwidthUp < 0 || c.BandwidthDown < 0 {
+		return errors.New("bandwidth limits must not be negative")
+	}
+	_, err = parseOriginPolicy(c.AllowedOrigins, c.AllowedHosts, c.Dev)
+	if err != nil {
+		return err
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("tls cert file and tls key file must be given together")
+	}
+	_, err = parseProxies(c.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	_, err = util.ParseLogLevel(c.LogLevel)
+	if err != nil {
+		return err
+	}
+	_, err = util.ParseLogFormat(c.LogFormat)
+	if err != nil {
+		return err
+	}
+	info, err := fs.Stat(c.assetsFS(), "gallery/pub")
+	if err != nil {
+		return fmt.Errorf("assets dir %s: %v", c.AssetsDir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("assets dir %s: gallery/pub is not a directory", c.AssetsDir)
+	}
+	if c.PrivateDir != "" {
+		info, err := os.Stat(c.PrivateDir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", c.PrivateDir)
+		}
+	}
+	if c.CompressedDir != "" {
+		info, err := os.Stat(filepath.Join(c.CompressedDir, "static"))
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", filepath.Join(c.CompressedDir, "static"))
+		}
+	}
+	_, err = fs.Stat(c.assetsFS(), "index.html")
+	if err != nil {
+		return fmt.Errorf("assets dir %s: %v", c.AssetsDir, err)
+	}
+	return nil
+}
+
+// index.html and the gallery, from -assets-dir or else the copies compiled
+// into the binary.
+func (c *Config) assetsFS() fs.FS {
+	if c.AssetsDir == "" {
+		return assets.FS
+	}
+	return os.DirFS(c.AssetsDir)
+}
+
+func (c *Config) pubFS() fs.FS {
+	sub, _ := fs.Sub(c.assetsFS(), "gallery/pub")
+	return sub
+}
+
+// The private gallery is never compiled in, so it comes from -private-dir or
+// -assets-dir and is empty if neither has one.
+func (c *Config) privFS() fs.FS {
+	if c.PrivateDir != "" {
+		return os.DirFS(c.PrivateDir)
+	}
+	if c.AssetsDir != "" {
+		info, err := fs.Stat(c.assetsFS(), "gallery/priv")
+		if err == nil && info.IsDir() {
+			sub, _ := fs.Sub(c.assetsFS(), "gallery/priv")
+			return sub
+		}
+	}
+	return emptyFS{}
+}
+
+// A file system with no files, standing in for a missing private gallery.
+type emptyFS struct{}
+
+func (emptyFS) Open(name string) (fs.File, error) {
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (emptyFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name == "." {
+		return nil, nil
+	}
+	return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+}
+
+func (c *Config) wsLimits() wsLimits {
+	return wsLimits{
+		MaxSessions:        c.MaxSessions,
+		MaxSessionsPerIP:   c.MaxSessionsPerIP,
+		SessionRate:        c.SessionRate,
+		SessionRatePerIP:   c.SessionRatePerIP,
+		HandshakeRate:      c.HandshakeRate,
+		HandshakeRatePerIP: c.HandshakeRatePerIP,
+	}
+}
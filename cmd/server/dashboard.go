@@ -0,0 +1,207 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dashboardEvents  = 100 // recent virtual requests kept for new viewers
+	dashboardSamples = 120 // seconds of throughput history
+)
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// A request seen by the virtual file server.
+type ActivityEvent struct {
+	Time    time.Time `json:"time"`
+	Peer    string    `json:"peer"`
+	Session string    `json:"session,omitempty"`
+	Method  string    `json:"method"`
+	Path    string    `json:"path"`
+	Status  int       `json:"status"`
+	Denied  bool      `json:"denied"`
+}
+
+// Bytes per second through the websocket bind.
+type throughputSample struct {
+	Time time.Time `json:"time"`
+	Rx   float64   `json:"rx"`
+	Tx   float64   `json:"tx"`
+}
+
+// Sent to dashboard viewers once a second.
+type dashboardUpdate struct {
+	Sessions []sessionInfo      `json:"sessions"`
+	Samples  []throughputSample `json:"samples"`
+	Events   []ActivityEvent    `json:"events"`
+}
+
+// Collects virtual network activity and streams it to dashboard viewers.
+type Dashboard struct {
+	sessions    *SessionTable
+	mu          sync.Mutex // protects following fields
+	events      []ActivityEvent
+	pending     []ActivityEvent
+	samples     []throughputSample
+	subscribers map[chan dashboardUpdate]struct{}
+}
+
+func NewDashboard(sessions *SessionTable) *Dashboard {
+	return &Dashboard{
+		sessions:    sessions,
+		events:      []ActivityEvent{},
+		pending:     []ActivityEvent{},
+		subscribers: make(map[chan dashboardUpdate]struct{}),
+	}
+}
+
+func (d *Dashboard) Record(e ActivityEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.events = appendLimited(d.events, e, dashboardEvents)
+	d.pending = appendLimited(d.pending, e, dashboardEvents)
+}
+
+func appendLimited[T any](s []T, v T, limit int) []T {
+	s = append(s, v)
+	if len(s) > limit {
+		s = s[len(s)-limit:]
+	}
+	return s
+}
+
+// Sample throughput and push an update to viewers every second.
+func (d *Dashboard) Run() {
+	lastRx, lastTx := bindBytes.Value("rx"), bindBytes.Value("tx")
+	ticker := time.NewTicker(time.Second)
+	for now := range ticker.C {
+		rx, tx := bindBytes.Value("rx"), bindBytes.Value("tx")
+		sample := throughputSample{Time: now, Rx: rx - lastRx, Tx: tx - lastTx}
+		lastRx, lastTx = rx, tx
+		sessions := listSessions(d.sessions)
+
+		d.mu.Lock()
+		d.samples = appendLimited(d.samples, sample, dashboardSamples)
+		update := dashboardUpdate{Sessions: sessions, Samples: []throughputSample{sample}, Events: d.pending}
+		d.pending = []ActivityEvent{}
+		for ch := range d.subscribers {
+			// Viewers that fall behind miss updates rather than stall the rest.
+			select {
+			case ch <- update:
+			default:
+			}
+		}
+		d.mu.Unlock()
+	}
+}
+
+// Everything a new viewer needs to draw the page.
+func (d *Dashboard) subscribe() (chan dashboardUpdate, dashboardUpdate) {
+	// Listing sessions asks every device over IPC, so do it before taking
+	// the lock broadcasts need.
+	sessions := listSessions(d.sessions)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ch := make(chan dashboardUpdate, 8)
+	d.subscribers[ch] = struct{}{}
+	snapshot := dashboardUpdate{
+		Sessions: sessions,
+		Samples:  append([]throughputSample{}, d.samples...),
+		Events:   append([]ActivityEvent{}, d.events...),
+	}
+	return ch, snapshot
+}
+
+func (d *Dashboard) unsubscribe(ch chan dashboardUpdate) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.subscribers, ch)
+}
+
+// Serve the dashboard page.
+func (d *Dashboard) pageHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dashboard/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardPage)
+	})
+}
+
+// Stream dashboard updates as server-sent events.
+func (d *Dashboard) eventsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+
+		ch, snapshot := d.subscribe()
+		defer d.unsubscribe(ch)
+
+		update := snapshot
+		for {
+			b, err := json.Marshal(update)
+			if err != nil {
+				return
+			}
+			_, err = fmt.Fprintf(w, "data: %s\n\n", b)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+
+			select {
+			case update = <-ch:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
+
+// Record virtual file server requests for the dashboard.
+func activityWrapper(d *Dashboard, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		peer := r.RemoteAddr
+		if addr, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+			peer = addr.Addr().String()
+		}
+		var session string
+		if s := sessionFromContext(r.Context()); s != nil {
+			session = s.ID
+		}
+		d.Record(ActivityEvent{
+			Time:    time.Now(),
+			Peer:    peer,
+			Session: session,
+			Method:  r.Method,
+			Path:    r.URL.Path,
+			Status:  rec.status,
+			Denied:  rec.status == http.StatusForbidden && strings.HasPrefix(r.URL.Path, "/private/"),
+		})
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"kraken/util"
+)
+
+const (
+	signingKeyEnv     = "KRAKEN_SIGNING_KEY"
+	discoveryValidity = 24 * time.Hour
+)
+
+// Load the ed25519 seed that signs discovery documents from filename or
+// $KRAKEN_SIGNING_KEY. There is no fallback: a random key would publish
+// documents that no client accepts.
+func loadSigningKey(filename string) (ed25519.PrivateKey, error) {
+	encoded := os.Getenv(signingKeyEnv)
+	if filename != "" {
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(b)
+	}
+
+	if strings.TrimSpace(encoded) == "" {
+		return nil, fmt.Errorf("no signing key configured, set -signing-key-file or $%s", signingKeyEnv)
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("signing key: expected %d base64-encoded bytes", ed25519.SeedSize)
+	}
+	key := ed25519.NewKeyFromSeed(seed)
+	pub := base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	if pub != util.DiscoverySigningKey {
+		logger.Warn("signing key is not util.DiscoverySigningKey, clients need it passed in", "public_key", pub)
+	}
+	return key, nil
+}
+
+// Serves the signed discovery document, re-signing it before it expires.
+type discoveryPublisher struct {
+	mu     sync.Mutex // protects following fields
+	doc    util.Discovery
+	key    ed25519.PrivateKey
+	signed []byte
+}
+
+func newDiscoveryPublisher(cfg *Config, keyring Keyring, key ed25519.PrivateKey) *discoveryPublisher {
+	doc := util.Discovery{
+		Version:        util.DiscoveryVersion,
+		VirtualAddress: cfg.VirtualAddress,
+		VirtualPort:    cfg.VirtualPort,
+		MTU:            cfg.MTU,
+		Endpoints:      []string{"/ws"},
+		Protocols:      []int{util.ProtocolVersion},
+	}
+	for _, t := range keyring {
+		doc.Keys = append(doc.Keys, base64.StdEncoding.EncodeToString(t.PublicKey[:]))
+	}
+
+	return &discoveryPublisher{doc: doc, key: key}
+}
+
+func (p *discoveryPublisher) document() ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if p.signed != nil && now.Before(p.doc.Issued.Add(discoveryValidity/2)) {
+		return p.signed, nil
+	}
+
+	p.doc.Issued = now.UTC().Truncate(time.Second)
+	p.doc.Expires = p.doc.Issued.Add(discoveryValidity)
+	signed, err := util.SignDiscovery(p.doc, p.key)
+	if err != nil {
+		return nil, err
+	}
+	p.signed, err = json.Marshal(signed)
+	return p.signed, err
+}
+
+func (p *discoveryPublisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	doc, err := p.document()
+	if err != nil {
+		logger.Error("signing discovery document", "err", err)
+		http.Error(w, "discovery unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(doc)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"kraken/util"
+)
+
+// The published document verifies against the signing key's public half
+// and lists the keyring in order.
+func TestDiscoveryPublisherSigns(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := Keyring{&Tunnel{}, &Tunnel{}}
+	keyring[0].PublicKey[0] = 1
+	keyring[1].PublicKey[0] = 2
+
+	p := newDiscoveryPublisher(defaultConfig(), keyring, key)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", util.DiscoveryPath, nil))
+
+	var signed util.SignedDiscovery
+	err = json.Unmarshal(w.Body.Bytes(), &signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := signed.Verify(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Keys) != 2 || d.Keys[0] != base64.StdEncoding.EncodeToString(keyring[0].PublicKey[:]) || d.Keys[1] != base64.StdEncoding.EncodeToString(keyring[1].PublicKey[:]) {
+		t.Errorf("got keys %v", d.Keys)
+	}
+	if !d.Expires.After(d.Issued) {
+		t.Errorf("document expires %v, before it was issued %v", d.Expires, d.Issued)
+	}
+}
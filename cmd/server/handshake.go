@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+
+	"kraken/util"
+)
+
+const (
+	maxProofFailures   = 5
+	proofFailureWindow = time.Minute
+)
+
+var (
+	errBadProof             = errors.New("proof of possession failed")
+	errPresharedKeyMismatch = errors.New("preshared key mismatch")
+	errPuzzleUnsolved       = errors.New("admission puzzle not solved")
+)
+
+// Challenge the client to prove it holds the private key for clientPub and,
+// when psk is set, the same preshared key. A nonzero difficulty also sets an
+// admission puzzle, with time to solve it.
+func verifyClient(ctx context.Context, cfg *Config, c *websocket.Conn, serverPriv, clientPub []byte, psk *device.NoisePresharedKey, difficulty int) error {
+	timeout := time.Duration(cfg.HandshakeTimeout)
+	if difficulty > 0 {
+		timeout += 2 * puzzleSolveTime(difficulty)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	nonce := make([]byte, util.NonceSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+
+	err = wsjson.Write(ctx, c, util.Challenge{Nonce: nonce, PuzzleDifficulty: difficulty})
+	if err != nil {
+		return err
+	}
+
+	var resp util.ChallengeResponse
+	err = wsjson.Read(ctx, c, &resp)
+	if err != nil {
+		return err
+	}
+
+	if !util.VerifyProof(serverPriv, clientPub, nonce, resp.Proof) {
+		return errBadProof
+	}
+	if difficulty > 0 && !util.CheckPuzzle(nonce, clientPub, resp.PuzzleSolution, difficulty) {
+		return errPuzzleUnsolved
+	}
+	if psk == nil {
+		if len(resp.PresharedKeyProof) != 0 {
+			return errPresharedKeyMismatch
+		}
+		return nil
+	}
+	if !hmac.Equal(resp.PresharedKeyProof, util.PresharedKeyProof(psk[:], nonce)) {
+		return errPresharedKeyMismatch
+	}
+	return nil
+}
+
+// Tell the client its peer has been registered, and the session ID to quote
+// in its logs.
+func acceptClient(ctx context.Context, cfg *Config, c *websocket.Conn, session string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.HandshakeTimeout))
+	defer cancel()
+
+	return wsjson.Write(ctx, c, util.HandshakeResult{OK: true, Session: session})
+}
+
+type failureRecord struct {
+	count int
+	reset time.Time
+}
+
+// Counts failed proofs and logins per client address and blocks addresses
+// that fail too often.
+type failureLimiter struct {
+	mu       sync.Mutex // protects following fields
+	failures map[netip.Addr]*failureRecord
+	total    uint64
+}
+
+func newFailureLimiter() *failureLimiter {
+	return &failureLimiter{failures: make(map[netip.Addr]*failureRecord)}
+}
+
+func (l *failureLimiter) Allow(addr netip.Addr) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rec, ok := l.failures[addr]
+	if !ok {
+		return true
+	}
+	if time.Now().After(rec.reset) {
+		delete(l.failures, addr)
+		return true
+	}
+	return rec.count < maxProofFailures
+}
+
+func (l *failureLimiter) Fail(addr netip.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for a, rec := range l.failures {
+		if now.After(rec.reset) {
+			delete(l.failures, a)
+		}
+	}
+
+	rec, ok := l.failures[addr]
+	if !ok {
+		rec = &failureRecord{reset: now.Add(proofFailureWindow)}
+		l.failures[addr] = rec
+	}
+	rec.count++
+	l.total++
+}
+
+func (l *failureLimiter) Total() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.total
+}
+
+// Read a base64 preshared key shared by every ephemeral peer.
+func loadPresharedKey(filename string) (*device.NoisePresharedKey, error) {
+	if filename == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := util.ParseKey(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	psk := new(device.NoisePresharedKey)
+	copy(psk[:], key)
+	return psk, nil
+}
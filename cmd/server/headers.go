@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Where the index page loads its stylesheet from.
+const stylesheetOrigin = "https://unpkg.com"
+
+type nonceContextKey struct{}
+
+// Nonce that inline scripts and styles in the response must carry.
+func cspNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(nonceContextKey{}).(string)
+	return nonce
+}
+
+// Content-Security-Policy allowing only the server's own scripts, inline
+// scripts and styles carrying nonce, and images the wasm client hands back as
+// data: URLs. 'wasm-unsafe-eval' lets the page compile transfer.wasm without
+// allowing eval in scripts.
+func contentSecurityPolicy(nonce string) string {
+	return strings.Join([]string{
+		"default-src 'self'",
+		fmt.Sprintf("script-src 'self' 'nonce-%s' 'wasm-unsafe-eval'", nonce),
+		fmt.Sprintf("style-src 'self' 'nonce-%s' %s", nonce, stylesheetOrigin),
+		"img-src 'self' data:",
+		"connect-src 'self'",
+		"object-src 'none'",
+		"base-uri 'none'",
+		"form-action 'self'",
+		"frame-ancestors 'none'",
+	}, "; ")
+}
+
+// Set security headers on every response from the physical server. Each
+// response gets a fresh CSP nonce that handlers read with cspNonce. HSTS,
+// if hsts is positive, is only sent over TLS.
+func securityHeadersWrapper(hsts time.Duration, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := make([]byte, 16)
+		randomID(b)
+		nonce := base64.StdEncoding.EncodeToString(b)
+
+		header := w.Header()
+		header.Set("Content-Security-Policy", contentSecurityPolicy(nonce))
+		header.Set("X-Content-Type-Options", "nosniff")
+		// Tokens and invites travel in the page address, so never send it on.
+		header.Set("Referrer-Policy", "no-referrer")
+		header.Set("X-Frame-Options", "DENY")
+		header.Set("Cross-Origin-Opener-Policy", "same-origin")
+		if hsts > 0 && r.TLS != nil {
+			header.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d", int(hsts.Seconds())))
+		}
+
+		ctx := context.WithValue(r.Context(), nonceContextKey{}, nonce)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// How often the tunnels are probed. /readyz only reports the last
+	// result, so callers can't make the server add probe peers.
+	readyInterval = 5 * time.Second
+	probeTimeout  = 5 * time.Second
+)
+
+// Probe peers take a random address from this prefix, out of the way of
+// registered peers and anything a client is likely to pick.
+var probePrefix = netip.MustParsePrefix("fd6b:7261:6b65:6e00::/64")
+
+// Probes are serialized, so every probe can use the same bind endpoint.
+var probeEndpoint = WSEndpoint(netip.AddrPortFrom(probePrefix.Addr(), 0))
+
+// The healthcheck subcommand exits 0 if url answers 200, for container
+// images without curl.
+func healthcheckCommand(args []string) int {
+	url := "http://localhost/readyz"
+	switch len(args) {
+	case 0:
+	case 1:
+		url = args[0]
+	default:
+		fmt.Fprintln(os.Stderr, "usage: server healthcheck [url]")
+		return 2
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", url, resp.Status)
+		return 1
+	}
+	return 0
+}
+
+// Liveness: the process is up and serving HTTP.
+func healthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok\n")
+	})
+}
+
+// Readiness: every tunnel carried a request end to end in the last probe.
+// Answers 503 until the first probe finishes, while any probe fails, or
+// while the server is draining.
+func readyzHandler(checker *ReadinessChecker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		readiness := checker.Check()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if !readiness.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(readiness)
+	})
+}
+
+type Readiness struct {
+	Ready    bool          `json:"ready"`
+	Draining bool          `json:"draining,omitempty"`
+	Checked  time.Time     `json:"checked"`
+	Tunnels  []tunnelProbe `json:"tunnels"`
+}
+
+type tunnelProbe struct {
+	Key    string       `json:"key"`
+	OK     bool         `json:"ok"`
+	Error  string       `json:"error,omitempty"`
+	Stages []probeStage `json:"stages"`
+}
+
+type probeStage struct {
+	Name     string `json:"name"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Probes each tunnel with an internal ephemeral peer that fetches a public
+// asset from the virtual file server.
+type ReadinessChecker struct {
+	cfg      *Config
+	keyring  Keyring
+	reloader *Reloader
+	sessions *SessionTable
+	mu       sync.Mutex // protects last
+	last     *Readiness
+}
+
+func NewReadinessChecker(cfg *Config, keyring Keyring, reloader *Reloader, sessions *SessionTable) *ReadinessChecker {
+	return &ReadinessChecker{cfg: cfg, keyring: keyring, reloader: reloader, sessions: sessions}
+}
+
+// The last probe result; not ready until the first probe has finished.
+func (c *ReadinessChecker) Check() Readiness {
+	if c.sessions.Draining() {
+		return Readiness{Draining: true, Checked: time.Now(), Tunnels: []tunnelProbe{}}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.last == nil {
+		return Readiness{Tunnels: []tunnelProbe{}}
+	}
+	return *c.last
+}
+
+// Probes every tunnel now and then every readyInterval.
+func (c *ReadinessChecker) Run() {
+	ticker := time.NewTicker(readyInterval)
+	for {
+		if !c.sessions.Draining() {
+			readiness := c.probeAll(context.Background())
+			c.mu.Lock()
+			c.last = &readiness
+			c.mu.Unlock()
+		}
+		<-ticker.C
+	}
+}
+
+func (c *ReadinessChecker) probeAll(ctx context.Context) Readiness {
+	readiness := Readiness{Ready: true, Checked: time.Now(), Tunnels: []tunnelProbe{}}
+	for _, t := range c.keyring {
+		p := c.probe(ctx, t)
+		if !p.OK {
+			readiness.Ready = false
+			logger.Warn("readiness probe failed", "server_key", p.Key, "err", p.Error)
+		}
+		readiness.Tunnels = append(readiness.Tunnels, p)
+	}
+	return readiness
+}
+
+// The public file a probe fetches: the first gallery image, or the
+// collection listing if there are none.
+func (c *ReadinessChecker) target() string {
+	for _, collection := range c.reloader.State().Gallery.Public {
+		if len(collection.Images) > 0 {
+			return path.Join("/public", collection.Name, collection.Images[0].Path)
+		}
+	}
+	return "/public/"
+}
+
+func (c *ReadinessChecker) probe(ctx context.Context, t *Tunnel) tunnelProbe {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	p := tunnelProbe{Key: base64.StdEncoding.EncodeToString(t.PublicKey[:])}
+	stage := func(name string, f func() error) bool {
+		start := time.Now()
+		err := f()
+		s := probeStage{Name: name, Duration: time.Since(start).String()}
+		if err != nil {
+			s.Error = err.Error()
+			p.Error = fmt.Sprintf("%s: %v", name, err)
+		}
+		p.Stages = append(p.Stages, s)
+		return err == nil
+	}
+
+	var client *probeClient
+	var tcp net.Conn
+	p.OK = stage("peer", func() (err error) {
+		client, err = newProbeClient(c.cfg, t)
+		return err
+	})
+	if client != nil {
+		defer client.Close()
+	}
+	p.OK = p.OK && stage("connect", func() (err error) {
+		addr := net.JoinHostPort(c.cfg.VirtualAddress, fmt.Sprint(c.cfg.VirtualPort))
+		tcp, err = client.tnet.DialContext(ctx, "tcp", addr)
+		return err
+	})
+	if tcp != nil {
+		defer tcp.Close()
+	}
+	p.OK = p.OK && stage("fetch", func() error {
+		return probeFetch(ctx, tcp, c.target())
+	})
+	return p
+}
+
+// GET target over conn and read the whole response.
+func probeFetch(ctx context.Context, conn net.Conn, target string) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://kraken"+target, nil)
+	if err != nil {
+		return err
+	}
+	err = req.Write(conn)
+	if err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", target, resp.Status)
+	}
+	return nil
+}
+
+// A WireGuard device on its own netstack, registered as an ephemeral peer of
+// a tunnel.
+type probeClient struct {
+	tunnel *Tunnel
+	key    device.NoisePublicKey
+	dev    *device.Device
+	tnet   *netstack.Net
+}
+
+func newProbeClient(cfg *Config, t *Tunnel) (*probeClient, error) {
+	priv, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	pub := priv.PublicKey()
+
+	var addr [16]byte
+	copy(addr[:], probePrefix.Addr().AsSlice())
+	randomID(addr[8:])
+	probeAddr := netip.AddrFrom16(addr)
+
+	tun, tnet, err := netstack.CreateNetTUN([]netip.Addr{probeAddr}, []netip.Addr{}, cfg.MTU)
+	if err != nil {
+		return nil, err
+	}
+	dev := device.NewDevice(tun, &probeBind{tunnel: t}, logger.With("probe", true).DeviceLogger(nil))
+	client := &probeClient{tunnel: t, key: device.NoisePublicKey(pub), dev: dev, tnet: tnet}
+
+	err = t.dev.IpcSet(fmt.Sprintf("public_key=%s\nallowed_ip=%v", hex.EncodeToString(pub[:]), netip.PrefixFrom(probeAddr, probeAddr.BitLen())))
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+	err = dev.IpcSet(fmt.Sprintf("private_key=%s\npublic_key=%s\nendpoint=%s\nallowed_ip=0.0.0.0/0\nallowed_ip=::/0",
+		hex.EncodeToString(priv[:]),
+		hex.EncodeToString(t.PublicKey[:]),
+		probeEndpoint.DstToString(),
+	))
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	err = dev.Up()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func (c *probeClient) Close() {
+	c.tunnel.dev.RemovePeer(c.key)
+	c.dev.Close()
+}
+
+// Hands a probe device's datagrams straight to a tunnel's bind, standing in
+// for a websocket session.
+type probeBind struct {
+	tunnel *Tunnel
+	mu     sync.Mutex // protects following fields
+	recv   chan []byte
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+var _ conn.Bind = (*probeBind)(nil)
+
+func (b *probeBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.recv = make(chan []byte, sendQueueLen)
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	recv, ctx := b.recv, b.ctx
+	receive := func(buff []byte) (int, conn.Endpoint, error) {
+		select {
+		case data := <-recv:
+			return copy(buff, data), probeEndpoint, nil
+		case <-ctx.Done():
+			return 0, nil, net.ErrClosed
+		}
+	}
+	return []conn.ReceiveFunc{receive}, port, nil
+}
+
+func (b *probeBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.cancel != nil {
+		b.cancel()
+	}
+	return nil
+}
+
+func (b *probeBind) Send(buff []byte, endpoint conn.Endpoint) error {
+	b.mu.Lock()
+	recv, ctx := b.recv, b.ctx
+	b.mu.Unlock()
+	if ctx == nil {
+		return net.ErrClosed
+	}
+
+	select {
+	case b.tunnel.wsChan <- WSMessage{
+		buff:     append([]byte(nil), buff...),
+		endpoint: probeEndpoint,
+		response: WSResponse{data: recv, ctx: ctx},
+	}:
+		return nil
+	case <-ctx.Done():
+		return net.ErrClosed
+	}
+}
+
+func (*probeBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	return probeEndpoint, nil
+}
+
+func (*probeBind) SetMark(mark uint32) error {
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"kraken/util"
+)
+
+const privateKeysEnv = "KRAKEN_PRIVATE_KEYS"
+
+// A WireGuard device answering for one server key. Several run side by side
+// while a key is being rotated.
+type Tunnel struct {
+	PrivateKey []byte
+	PublicKey  device.NoisePublicKey
+	dev        *device.Device
+	tnet       *netstack.Net
+	wsChan     chan WSMessage
+}
+
+// Server keys, preferred key first.
+type Keyring []*Tunnel
+
+// Load server private keys from filename, one base64 key per line, or from
+// $KRAKEN_PRIVATE_KEYS as a comma separated list. Without either a random key
+// is generated, which clients pick up through discovery.
+func loadServerKeys(filename string) ([][]byte, error) {
+	var encoded []string
+	switch {
+	case filename != "":
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = line[:i]
+			}
+			if line = strings.TrimSpace(line); line != "" {
+				encoded = append(encoded, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	case os.Getenv(privateKeysEnv) != "":
+		encoded = splitList(os.Getenv(privateKeysEnv))
+	default:
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return nil, err
+		}
+		logger.Warn("no server keys configured, generated ephemeral key", "public_key", key.PublicKey())
+		return [][]byte{key[:]}, nil
+	}
+
+	keys := [][]byte{}
+	for _, s := range encoded {
+		key, err := util.ParseKey(s)
+		if err != nil {
+			return nil, fmt.Errorf("server key: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no server keys found")
+	}
+	return keys, nil
+}
+
+// Make a virtual device for privateKey with every registered peer configured.
+func newTunnel(cfg *Config, privateKey []byte, peers *PeerConfig, logger *device.Logger) (*Tunnel, error) {
+	tun, tnet, err := netstack.CreateNetTUN(
+		[]netip.Addr{netip.MustParseAddr(cfg.VirtualAddress)},
+		[]netip.Addr{},
+		cfg.MTU,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Setup websocket bind for device.
+	wsChan := make(chan WSMessage)
+	bind := NewWSBind(wsChan)
+	dev := device.NewDevice(tun, bind, logger)
+	err = dev.IpcSet(fmt.Sprintf("private_key=%s", hex.EncodeToString(privateKey)))
+	if err != nil {
+		return nil, err
+	}
+
+	// Registered peers stay on the device across websocket sessions.
+	for _, peer := range peers.Peers {
+		err = dev.IpcSet(peer.ipcConfig())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = dev.Up()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Tunnel{PrivateKey: privateKey, dev: dev, tnet: tnet, wsChan: wsChan}
+	pub := wgtypes.Key(*(*[32]byte)(privateKey)).PublicKey()
+	copy(t.PublicKey[:], pub[:])
+	return t, nil
+}
+
+// Find the tunnel for a base64 public key, or the preferred one if empty.
+func (k Keyring) Lookup(pubKey string) *Tunnel {
+	if pubKey == "" {
+		return k[0]
+	}
+	for _, t := range k {
+		if base64.RawURLEncoding.EncodeToString(t.PublicKey[:]) == pubKey {
+			return t
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Limits on /ws, overall and per client address. Rates are per minute and
+// zero means unlimited.
+type wsLimits struct {
+	MaxSessions        int
+	MaxSessionsPerIP   int
+	SessionRate        int
+	SessionRatePerIP   int
+	HandshakeRate      int
+	HandshakeRatePerIP int
+}
+
+// Why a /ws request was turned away, and when the client may try again.
+type limitError struct {
+	limit string
+	retry time.Duration
+}
+
+func (e *limitError) Error() string {
+	return fmt.Sprintf("%s limit reached", e.limit)
+}
+
+// Retry-After value, in whole seconds.
+func (e *limitError) RetryAfter() string {
+	return fmt.Sprint(int(math.Ceil(e.retry.Seconds())))
+}
+
+// Admits websocket sessions within the configured limits.
+type SessionLimiter struct {
+	limits             wsLimits
+	sessionLifetime    time.Duration
+	mu                 sync.Mutex // protects following fields
+	active             map[netip.Addr]int
+	total              int
+	sessionRate        *rateLimiter
+	sessionRatePerIP   *rateLimiter
+	handshakeRate      *rateLimiter
+	handshakeRatePerIP *rateLimiter
+}
+
+// sessionLifetime bounds how long a client waits for a concurrent slot.
+func NewSessionLimiter(limits wsLimits, sessionLifetime time.Duration) *SessionLimiter {
+	for name, v := range map[string]int{
+		"max_sessions":          limits.MaxSessions,
+		"max_sessions_per_ip":   limits.MaxSessionsPerIP,
+		"session_rate":          limits.SessionRate,
+		"session_rate_per_ip":   limits.SessionRatePerIP,
+		"handshake_rate":        limits.HandshakeRate,
+		"handshake_rate_per_ip": limits.HandshakeRatePerIP,
+	} {
+		wsLimit.Set(float64(v), name)
+	}
+	return &SessionLimiter{
+		limits:             limits,
+		sessionLifetime:    sessionLifetime,
+		active:             make(map[netip.Addr]int),
+		sessionRate:        newRateLimiter(limits.SessionRate),
+		sessionRatePerIP:   newRateLimiter(limits.SessionRatePerIP),
+		handshakeRate:      newRateLimiter(limits.HandshakeRate),
+		handshakeRatePerIP: newRateLimiter(limits.HandshakeRatePerIP),
+	}
+}
+
+// Admit a new session from addr. Every call counts as a handshake attempt.
+// On success the caller must call the returned release once the session ends.
+func (l *SessionLimiter) Admit(addr netip.Addr) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	err := takeBoth(now, addr, "handshake_rate", l.handshakeRate, "handshake_rate_per_ip", l.handshakeRatePerIP)
+	if err != nil {
+		return nil, err
+	}
+	if l.limits.MaxSessions > 0 && l.total >= l.limits.MaxSessions {
+		return nil, &limitError{"max_sessions", l.sessionLifetime}
+	}
+	if l.limits.MaxSessionsPerIP > 0 && l.active[addr] >= l.limits.MaxSessionsPerIP {
+		return nil, &limitError{"max_sessions_per_ip", l.sessionLifetime}
+	}
+	err = takeBoth(now, addr, "session_rate", l.sessionRate, "session_rate_per_ip", l.sessionRatePerIP)
+	if err != nil {
+		return nil, err
+	}
+
+	l.total++
+	l.active[addr]++
+	var once sync.Once
+	return func() {
+		once.Do(func() { l.release(addr) })
+	}, nil
+}
+
+func (l *SessionLimiter) release(addr netip.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	l.active[addr]--
+	if l.active[addr] <= 0 {
+		delete(l.active, addr)
+	}
+}
+
+// Take a token from both the overall and the per address bucket, or from
+// neither.
+func takeBoth(now time.Time, addr netip.Addr, globalName string, global *rateLimiter, perIPName string, perIP *rateLimiter) error {
+	if wait := global.wait(now, netip.Addr{}); wait > 0 {
+		return &limitError{globalName, wait}
+	}
+	if wait := perIP.wait(now, addr); wait > 0 {
+		return &limitError{perIPName, wait}
+	}
+	global.take(now, netip.Addr{})
+	perIP.take(now, addr)
+	return nil
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Token buckets refilling perMinute tokens a minute, up to perMinute. Callers
+// hold SessionLimiter.mu.
+type rateLimiter struct {
+	perMinute int
+	buckets   map[netip.Addr]*tokenBucket
+	swept     time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{perMinute: perMinute, buckets: make(map[netip.Addr]*tokenBucket)}
+}
+
+// Refill and return the bucket for addr.
+func (l *rateLimiter) bucket(now time.Time, addr netip.Addr) *tokenBucket {
+	burst := float64(l.perMinute)
+	refill := func(b *tokenBucket) {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Minutes()*burst)
+		b.last = now
+	}
+
+	// Full buckets are the same as missing ones, so drop them now and then.
+	if now.Sub(l.swept) > time.Minute {
+		for a, b := range l.buckets {
+			refill(b)
+			if b.tokens >= burst {
+				delete(l.buckets, a)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.buckets[addr]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[addr] = b
+	}
+	refill(b)
+	return b
+}
+
+// How long until addr has a token, zero if it has one now.
+func (l *rateLimiter) wait(now time.Time, addr netip.Addr) time.Duration {
+	if l.perMinute <= 0 {
+		return 0
+	}
+	b := l.bucket(now, addr)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / float64(l.perMinute) * float64(time.Minute))
+}
+
+func (l *rateLimiter) take(now time.Time, addr netip.Addr) {
+	if l.perMinute <= 0 {
+		return
+	}
+	l.bucket(now, addr).tokens--
+}
@@ -2,17 +2,22 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
 	"mime"
 	"net"
 	"net/http"
 	"net/netip"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sync"
-	"text/template"
+	"syscall"
 	"time"
 
 	"golang.zx2c4.com/wireguard/device"
@@ -22,23 +27,6 @@ import (
 	"kraken/util"
 )
 
-const (
-	privateKey = "2J6VczjFmT2RMsqS1ltsHwOHtGrwqept5BewhZ91blw="
-
-	assetsDir     = "../../assets/"
-	compressedDir = "../../compressed_assets/"
-
-	pubDir            = assetsDir + "gallery/pub/"
-	privDir           = assetsDir + "gallery/priv/"
-	compressedPubDir  = compressedDir + "gallery/pub/"
-	compressedPrivDir = compressedDir + "gallery/priv/"
-	staticDir         = compressedDir + "static/"
-	indexTemplate     = assetsDir + "index.html"
-
-	mtu     = util.MTU
-	timeout = 10
-)
-
 type Image struct {
 	Name string
 	Path string
@@ -54,53 +42,194 @@ type Gallery struct {
 	Private []Collection
 }
 
+// Data the index template is executed with.
+type indexPage struct {
+	Gallery
+	Nonce string // CSP nonce for inline scripts and styles
+}
+
 type CompressedDir struct {
 	d http.Dir
 }
 
+// Server-wide logger. Level and format follow the configuration.
+var logger = util.NewLogger(util.WriterSink(os.Stderr), util.FormatText, util.LevelInfo)
+
+// Exports spans to the trace file, if one is configured.
+var tracer *Tracer
+
 func main() {
-	// Make virtual device.
-	tun, tnet, err := netstack.CreateNetTUN(
-		[]netip.Addr{netip.MustParseAddr(util.ServerVirtualAddress)},
-		[]netip.Addr{},
-		mtu,
-	)
-	if err != nil {
-		log.Panic(err)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "verify-audit":
+			os.Exit(verifyAuditCommand(os.Args[2:]))
+		case "invite":
+			os.Exit(inviteCommand(os.Args[2:]))
+		case "healthcheck":
+			os.Exit(healthcheckCommand(os.Args[2:]))
+		}
 	}
 
-	// Setup websocket bind for device.
-	wsChan := make(chan WSMessage)
-	bind := NewWSBind(wsChan)
-	// DEBUG: dev := device.NewDevice(tun, bind, device.NewLogger(device.LogLevelVerbose, ""))
-	dev := device.NewDevice(tun, bind, device.NewLogger(device.LogLevelSilent, ""))
-	err = dev.IpcSet(fmt.Sprintf("private_key=%s", util.Base64KeyToHex(privateKey)))
+	cfg, check, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
 	if err != nil {
-		log.Panic(err)
+		logger.Fatal("config error", "err", err)
 	}
 
-	err = dev.Up()
+	sessions := NewSessionTable()
+	reloader, err := NewReloader(cfg, os.Args[1:], sessions)
+	if err != nil {
+		logger.Fatal("config error", "err", err)
+	}
+	psk, err := loadPresharedKey(cfg.PresharedKeyFile)
+	if err != nil {
+		logger.Fatal("config error", "err", err)
+	}
+	keys, err := loadServerKeys(cfg.KeyFile)
+	if err != nil {
+		logger.Fatal("config error", "err", err)
+	}
+	signingKey, err := loadSigningKey(cfg.SigningKeyFile)
 	if err != nil {
-		log.Panic(err)
+		logger.Fatal("config error", "err", err)
 	}
+	var adminToken string
+	if cfg.AdminListen != "" {
+		adminToken, err = loadAdminToken(cfg.AdminTokenFile)
+		if err != nil {
+			logger.Fatal("config error", "err", err)
+		}
+	}
+	if check {
+		fmt.Println("configuration ok")
+		return
+	}
+	tracer, err = openTracer(cfg.TraceFile)
+	if err != nil {
+		logger.Fatal("config error", "err", err)
+	}
+	defer tracer.Close()
+	proxies, err := parseProxies(cfg.TrustedProxies)
+	if err != nil {
+		logger.Fatal("config error", "err", err)
+	}
+	origins, err := parseOriginPolicy(cfg.AllowedOrigins, cfg.AllowedHosts, cfg.Dev)
+	if err != nil {
+		logger.Fatal("config error", "err", err)
+	}
+	tlsConfig, err := serverTLSConfig(cfg)
+	if err != nil {
+		logger.Fatal("config error", "err", err)
+	}
+	access, err := openAccessLog(cfg.AccessLog, reloader.State().LogFormat)
+	if err != nil {
+		logger.Fatal("config error", "err", err)
+	}
+	audit, err := openAuditLog(cfg.AuditLog)
+	if err != nil {
+		logger.Fatal("config error", "err", err)
+	}
+	defer audit.Close()
+	quotas, err := openQuotas(cfg.QuotaFile, cfg.QuotaPerKey, cfg.QuotaPerIP)
+	if err != nil {
+		logger.Fatal("config error", "err", err)
+	}
+	go quotas.Run()
+
+	// One virtual device and file server per server key.
+	dashboard := NewDashboard(sessions)
+	virtual := traceWrapper(sessions, accessLogWrapper(access, "virtual", activityWrapper(dashboard, virtualMetricsWrapper(virtualHandler(reloader, audit)))))
+	keyring := Keyring{}
+	virtualServers := []*http.Server{}
+	for _, key := range keys {
+		tunnel, err := newTunnel(cfg, key, reloader.State().Peers, logger.DeviceLogger(sessions.deviceLogAttrs))
+		if err != nil {
+			logger.Fatal("creating tunnel", "err", err)
+		}
+		keyring = append(keyring, tunnel)
 
-	// Virtual file server.
-	go serveFiles(tnet)
+		vs := &http.Server{Handler: virtual}
+		virtualServers = append(virtualServers, vs)
+		go serveFiles(cfg, tunnel.tnet, vs)
+	}
+	reloader.keyring = keyring
 
 	// "Real" server.
 	mux := http.NewServeMux()
 	server := http.Server{
-		Addr:    fmt.Sprintf(":%v", util.ServerPhysicalPort),
-		Handler: mux,
+		Addr:      cfg.Listen,
+		Handler:   realIPWrapper(proxies, accessLogWrapper(access, "physical", securityHeadersWrapper(time.Duration(cfg.HSTS), mux))),
+		TLSConfig: tlsConfig,
+	}
+
+	// Failed logins and failed handshakes share one limit per client.
+	failures := newFailureLimiter()
+	mux.Handle("/", authWrapper(reloader, failures, serveTemplate(reloader)))
+	bans := NewBanList()
+	mux.Handle("/ws", originWrapper(origins, authWrapper(reloader, failures, http.HandlerFunc(wsHandlerWrapper(cfg, keyring, reloader, psk, sessions, failures, NewSessionLimiter(cfg.wsLimits(), time.Duration(cfg.SessionTimeout)), bans, quotas, NewPuzzleGate(time.Duration(cfg.PuzzleTarget), cfg.MaxSessions, sessions))))))
+	mux.Handle("/metrics", metricsHandler())
+	mux.Handle("/healthz", healthzHandler())
+	readiness := NewReadinessChecker(cfg, keyring, reloader, sessions)
+	go readiness.Run()
+	mux.Handle("/readyz", readyzHandler(readiness))
+	mux.Handle(util.DiscoveryPath, newDiscoveryPublisher(cfg, keyring, signingKey))
+	mux.Handle("/static/", http.StripPrefix("/static/", staticHandler(cfg)))
+
+	serverErr := make(chan error, 1)
+	go func() {
+		if tlsConfig != nil {
+			serverErr <- server.ListenAndServeTLS("", "")
+			return
+		}
+		serverErr <- server.ListenAndServe()
+	}()
+
+	// Admin API on its own listener.
+	var adminServer *http.Server
+	if cfg.AdminListen != "" {
+		adminServer = &http.Server{
+			Addr:    cfg.AdminListen,
+			Handler: adminHandler(adminToken, reloader, sessions, bans, dashboard),
+		}
+		go dashboard.Run()
+		go func() {
+			serverErr <- adminServer.ListenAndServe()
+		}()
 	}
 
-	mux.Handle("/", serveTemplate())
-	mux.Handle("/ws", http.HandlerFunc(wsHandlerWrapper(dev, wsChan)))
-	mux.Handle("/static/", compressedWrapper(http.StripPrefix("/static/", http.FileServer(CompressedDir{http.Dir(staticDir)}))))
-	err = server.ListenAndServe()
+	// Reload on SIGHUP.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			err := reloader.Reload()
+			if err != nil {
+				logger.Error("reload failed", "err", err)
+				continue
+			}
+			logger.Info("reloaded configuration")
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	select {
+	case err = <-serverErr:
+		logger.Fatal("failed to start server", "err", err)
+	case <-ctx.Done():
+		stop()
+	}
+
+	shutdown(cfg, &server, sessions, virtualServers, keyring)
+	err = quotas.Save()
 	if err != nil {
-		fmt.Println("Failed to start server", err)
-		return
+		logger.Error("saving quotas", "err", err)
+	}
+	if adminServer != nil {
+		adminServer.Close()
 	}
 }
 
@@ -108,51 +237,57 @@ func (d CompressedDir) Open(name string) (http.File, error) {
 	return d.d.Open(name + ".gz")
 }
 
+// Files served on the virtual network.
+func virtualHandler(reloader *Reloader, audit *AuditLog) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/public/", http.StripPrefix("/public/", galleryHandler(reloader, func(s *State) fs.FS { return s.PublicFS })))
+	mux.Handle("/private/", auditWrapper(audit, localOnlyWrapper(reloader, http.StripPrefix("/private/", galleryHandler(reloader, func(s *State) fs.FS { return s.PrivateFS })))))
+	return mux
+}
+
+// Serve files from the gallery the index currently lists, so a reload that
+// moves it takes effect for downloads too.
+func galleryHandler(reloader *Reloader, files func(*State) fs.FS) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.FileServer(http.FS(files(reloader.State()))).ServeHTTP(w, r)
+	})
+}
+
 // Serve files using virtual server.
-func serveFiles(tnet *netstack.Net) {
-	l, err := tnet.ListenTCP(&net.TCPAddr{Port: util.ServerVirtualPort})
+func serveFiles(cfg *Config, tnet *netstack.Net, server *http.Server) {
+	l, err := tnet.ListenTCP(&net.TCPAddr{Port: cfg.VirtualPort})
 	if err != nil {
-		log.Panicln(err)
+		logger.Fatal("virtual server failed", "err", err)
 	}
 
-	http.Handle("/public/", http.StripPrefix("/public/", http.FileServer(http.Dir(pubDir))))
-	http.Handle("/private/", localOnlyWrapper(http.StripPrefix("/private/", http.FileServer(http.Dir(privDir)))))
-
-	err = http.Serve(l, nil)
-	if err != nil {
-		log.Panicln(err)
+	err = server.Serve(l)
+	if err != nil && err != http.ErrServerClosed {
+		logger.Fatal("virtual server failed", "err", err)
 	}
 }
 
 // Format image directories for template use.
-func collectionsFromDirectory(dir string) ([]Collection, error) {
-	dirFile, err := os.Open(dir)
-	if err != nil {
-		return []Collection{}, err
-	}
-	collectionNames, err := dirFile.Readdirnames(0)
+func collectionsFromFS(fsys fs.FS) ([]Collection, error) {
+	dirs, err := fs.ReadDir(fsys, ".")
 	if err != nil {
 		return []Collection{}, err
 	}
 	collections := []Collection{}
-	for _, dirName := range collectionNames {
+	for _, dir := range dirs {
 		images := []Image{}
-		dirFile, err = os.Open(filepath.Join(dir, dirName))
+		files, err := fs.ReadDir(fsys, dir.Name())
 		if err != nil {
 			return []Collection{}, err
 		}
-		imageNames, err := dirFile.Readdirnames(0)
-		if err != nil {
-			return []Collection{}, err
-		}
-		for _, fname := range imageNames {
+		for _, file := range files {
+			fname := file.Name()
 			images = append(images, Image{
 				Name: fname[:len(fname)-len(filepath.Ext(fname))],
 				Path: fname,
 			})
 		}
 		collections = append(collections, Collection{
-			Name:   dirName,
+			Name:   dir.Name(),
 			Images: images,
 		})
 	}
@@ -160,34 +295,33 @@ func collectionsFromDirectory(dir string) ([]Collection, error) {
 	return collections, nil
 }
 
-// Read filenames from gallery and serve template.
-func serveTemplate() http.Handler {
-	tmpl := template.Must(template.ParseFiles(indexTemplate))
-
-	publicImages, err := collectionsFromDirectory(pubDir)
-	if err != nil {
-		log.Panic(err)
-	}
-	privateImages, err := collectionsFromDirectory(privDir)
-	if err != nil {
-		log.Panic(err)
-	}
-
-	gallery := Gallery{
-		Public:  publicImages,
-		Private: privateImages,
-	}
-
+// Serve the index template with the current gallery.
+func serveTemplate(reloader *Reloader) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		tmpl.Execute(w, gallery)
+		state := reloader.State()
+		state.Template.Execute(w, indexPage{Gallery: state.Gallery, Nonce: cspNonce(r)})
 	})
 }
 
-// Only localhost can access these files.
-func localOnlyWrapper(h http.Handler) http.Handler {
+// Only localhost and registered peers granted access can access these files.
+func localOnlyWrapper(reloader *Reloader, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		remoteAddr := netip.MustParseAddrPort(r.RemoteAddr).Addr()
-		if remoteAddr != netip.MustParseAddr("127.0.0.1") && remoteAddr != netip.MustParseAddr("::1") {
+		remoteAddrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+		if err != nil {
+			logger.Warn("couldn't parse remote address", "remote_addr", r.RemoteAddr, "err", err)
+			http.Error(w, "unsupported remote address", http.StatusInternalServerError)
+			return
+		}
+		remoteAddr := remoteAddrPort.Addr()
+		peers := reloader.State().Peers
+		local := remoteAddr == netip.MustParseAddr("127.0.0.1") || remoteAddr == netip.MustParseAddr("::1")
+		if !local && !peers.Allowed(peers.PeerFor(remoteAddr), r.URL.Path) {
+			privateDenied.Inc()
+			log := logger
+			if s := sessionFromContext(r.Context()); s != nil {
+				log = s.log
+			}
+			log.Info("denied private request", "path", r.URL.Path, "peer", remoteAddr)
 			w.WriteHeader(http.StatusForbidden)
 			io.WriteString(w, "Remote access to this file is disabled")
 			return
@@ -206,18 +340,73 @@ func compressedWrapper(h http.Handler) http.Handler {
 }
 
 // WireGuard websocket handler.
-func wsHandlerWrapper(dev *device.Device, wsChan chan WSMessage) func(http.ResponseWriter, *http.Request) {
+func wsHandlerWrapper(cfg *Config, keyring Keyring, reloader *Reloader, psk *device.NoisePresharedKey, sessions *SessionTable, limiter *failureLimiter, sessionLimiter *SessionLimiter, bans *BanList, quotas *QuotaTracker, puzzles *PuzzleGate) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Get public key and virtual address from client and temporarily add to peer list.
+		// The session's root span names it in logs, traces and on the
+		// client. Every line about this tunnel carries its ID.
+		span := tracer.Start("ws session", nil, spanKindServer, "client.ip", clientIP(r).String())
+		defer span.End()
+		id := span.SpanID()
+		log := logger.With("session", id)
+		if tracer != nil {
+			log = log.With("trace", span.TraceID())
+		}
+		log = log.With("client", clientIP(r))
+		addAccessAttrs(r, "session", id)
+
+		if sessions.Draining() {
+			w.Header().Set("Retry-After", "30")
+			http.Error(w, errDraining.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		if bans.IPBanned(clientIP(r)) {
+			log.Info("rejected banned client")
+			span.Fail(errors.New("banned"))
+			http.Error(w, "banned", http.StatusForbidden)
+			return
+		}
+
+		if !limiter.Allow(clientIP(r)) {
+			log.Info("rejected client after too many failed handshakes")
+			span.Fail(errors.New("too many failed handshakes"))
+			http.Error(w, "too many failed handshakes", http.StatusTooManyRequests)
+			return
+		}
+
+		release, err := sessionLimiter.Admit(clientIP(r))
+		if err != nil {
+			limit := err.(*limitError)
+			wsRejected.Inc(limit.limit)
+			log.Info("rejected client over limit", "limit", limit.limit, "retry_after", limit.retry)
+			span.Fail(err)
+			w.Header().Set("Retry-After", limit.RetryAfter())
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		defer release()
+
+		// Clients name the server key they discovered; older ones get the preferred key.
+		tunnel := keyring.Lookup(r.URL.Query().Get("server"))
+		if tunnel == nil {
+			log.Warn("unknown server key", "server", r.URL.Query().Get("server"))
+			http.Error(w, "unknown server key", http.StatusBadRequest)
+			return
+		}
+		dev := tunnel.dev
+
+		// Get public key and virtual address from client.
 		pubKey := r.URL.Query().Get("pub")
 		pubKeyHex := util.UrlKeyToHex(pubKey)
 		if len(pubKeyHex) == 0 {
-			log.Printf("ws error: couldn't parse pub key")
+			log.Warn("couldn't parse pub key")
+			http.Error(w, "invalid public key", http.StatusBadRequest)
 			return
 		}
 		remoteAddr, err := netip.ParseAddr(r.URL.Query().Get("addr"))
 		if err != nil {
-			log.Printf("ws error: %v", err)
+			log.Warn("couldn't parse virtual address", "err", err)
+			http.Error(w, "invalid virtual address", http.StatusBadRequest)
 			return
 		}
 		remotePrefix := netip.PrefixFrom(remoteAddr, remoteAddr.BitLen())
@@ -225,32 +414,189 @@ func wsHandlerWrapper(dev *device.Device, wsChan chan WSMessage) func(http.Respo
 		npk := device.NoisePublicKey{}
 		err = npk.FromHex(pubKeyHex)
 		if err != nil {
-			log.Printf("ws error: %v", err)
+			log.Warn("couldn't parse pub key", "err", err)
+			http.Error(w, "invalid public key", http.StatusBadRequest)
+			return
+		}
+
+		keyString := base64.StdEncoding.EncodeToString(npk[:])
+		addAccessAttrs(r, "key", keyString, "virtual_addr", remoteAddr)
+
+		if bans.KeyBanned(npk) {
+			log.Info("rejected banned key", "key", keyString)
+			span.Fail(errors.New("banned"))
+			http.Error(w, "banned", http.StatusForbidden)
 			return
 		}
-		err = dev.IpcSet(fmt.Sprintf("public_key=%s\nallowed_ip=%v", pubKeyHex, remotePrefix))
+
+		err = quotas.Check(npk, clientIP(r))
 		if err != nil {
-			log.Printf("ws error: %v", err)
+			log.Info("rejected client over quota", "key", keyString, "err", err)
+			span.Fail(err)
+			w.Header().Set("Retry-After", fmt.Sprint(int(untilQuotaReset().Seconds())+1))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
 			return
 		}
-		defer dev.RemovePeer(npk)
 
-		// Upgrade request conn to websocket with timeout.
-		// Loop over read/write and forward packets to virtual interface.
-		c, err := websocket.Accept(w, r, nil)
+		// Registered peers must use one of their fixed addresses, and nobody
+		// else may claim those addresses.
+		peers := reloader.State().Peers
+		registered := peers.Lookup(npk)
+		if registered != nil && !registered.Owns(remoteAddr) {
+			log.Warn("address not allowed for registered peer", "addr", remoteAddr, "peer", registered.Name)
+			http.Error(w, "address not allowed for this key", http.StatusForbidden)
+			return
+		}
+		if registered == nil && peers.Reserved(remotePrefix) {
+			log.Warn("address reserved for a registered peer", "addr", remoteAddr)
+			http.Error(w, "address reserved", http.StatusForbidden)
+			return
+		}
+
+		// The bind tells sessions apart by the physical address, so the
+		// listener must report one.
+		remoteAddrPort, err := netip.ParseAddrPort(r.RemoteAddr)
 		if err != nil {
-			log.Printf("ws error: %v", err)
+			log.Warn("couldn't parse remote address", "remote_addr", r.RemoteAddr, "err", err)
+			http.Error(w, "unsupported remote address", http.StatusInternalServerError)
+			return
+		}
+		endpoint := WSEndpoint(remoteAddrPort)
+
+		// Upgrade request conn to websocket with timeout. originWrapper has
+		// already checked the Origin header more thoroughly than Accept would.
+		c, err := websocket.Accept(w, r, &websocket.AcceptOptions{InsecureSkipVerify: true})
+		if err != nil {
+			log.Warn("websocket upgrade failed", "err", err)
 			return
 		}
 		defer c.Close(websocket.StatusNormalClosure, "")
 
-		ctx, cancel := context.WithTimeout(r.Context(), time.Second*timeout)
+		session := &Session{
+			ID:        id,
+			PublicKey: npk,
+			Addr:      remoteAddr,
+			ClientIP:  clientIP(r),
+			Started:   time.Now(),
+			tunnel:    tunnel,
+			conn:      c,
+			log:       log,
+			span:      span,
+			up:        newByteBucket(cfg.BandwidthUp),
+			down:      newByteBucket(cfg.BandwidthDown),
+			quotas:    quotas,
+		}
+		span.SetAttrs("session.id", id, "peer.key", keyString, "peer.addr", remoteAddr.String(), "peer.registered", registered != nil)
+
+		// Registered peers may carry their own preshared key.
+		peerPSK := psk
+		if registered != nil {
+			peerPSK = registered.PresharedKey
+		}
+
+		// Only add the client to the peer list once it has proven it holds
+		// the matching private key.
+		// Anonymous peers may also have to solve a puzzle first.
+		difficulty := 0
+		if registered == nil {
+			difficulty = puzzles.Difficulty()
+		}
+		handshake := tracer.Start("handshake", span, spanKindInternal, "puzzle.difficulty", difficulty)
+		defer handshake.End()
+		err = verifyClient(r.Context(), cfg, c, tunnel.PrivateKey, npk[:], peerPSK, difficulty)
+		if err != nil {
+			handshake.Fail(err)
+			span.Fail(err)
+			var reason string
+			switch err {
+			case errBadProof:
+				reason = "proof"
+			case errPresharedKeyMismatch:
+				reason = "psk"
+			case errPuzzleUnsolved:
+				reason = "puzzle"
+			default:
+				// Timeouts and dropped connections say nothing about the
+				// client's key, so they don't count towards a ban.
+				handshakeFailures.Inc("io")
+				log.Info("handshake aborted", "err", err)
+				c.Close(websocket.StatusPolicyViolation, "handshake not completed")
+				return
+			}
+			handshakeFailures.Inc(reason)
+			limiter.Fail(clientIP(r))
+			log.Warn("handshake failed", "err", err, "failed_handshakes", limiter.Total())
+			c.Close(websocket.StatusPolicyViolation, err.Error())
+			return
+		}
+
+		// Only sessions that proved their key are visible to the rest of the
+		// server, which attributes virtual traffic to them by address.
+		err = sessions.Add(session)
+		if err != nil {
+			handshake.Fail(err)
+			span.Fail(err)
+			log.Warn("rejected session", "addr", remoteAddr, "err", err)
+			if err == errDraining {
+				c.Close(websocket.StatusGoingAway, err.Error())
+			} else {
+				c.Close(websocket.StatusPolicyViolation, err.Error())
+			}
+			return
+		}
+		defer sessions.Remove(session)
+
+		if registered == nil {
+			register := tracer.Start("register peer", handshake, spanKindInternal)
+			config := fmt.Sprintf("public_key=%s\nallowed_ip=%v", pubKeyHex, remotePrefix)
+			if psk != nil {
+				config += fmt.Sprintf("\npreshared_key=%s", hex.EncodeToString(psk[:]))
+			}
+			err = dev.IpcSet(config)
+			if err != nil {
+				register.Fail(err)
+				register.End()
+				span.Fail(err)
+				log.Error("adding peer", "err", err)
+				return
+			}
+			register.End()
+			peersAdded.Inc()
+		}
+
+		// Ephemeral peers, and registered peers dropped by a reload while
+		// connected, are removed on disconnect.
+		defer func() {
+			if reloader.State().Peers.Lookup(npk) == nil {
+				for _, t := range keyring {
+					t.dev.RemovePeer(npk)
+				}
+				peersRemoved.Inc()
+			}
+		}()
+
+		err = acceptClient(r.Context(), cfg, c, id)
+		if err != nil {
+			handshake.Fail(err)
+			span.Fail(err)
+			log.Warn("handshake failed", "err", err)
+			return
+		}
+		handshake.End()
+		session.firstRx = tracer.Start("first packet", span, spanKindInternal)
+		defer session.firstRx.End()
+		log.Info("session started", "key", keyString, "addr", remoteAddr, "registered", registered != nil)
+		defer func() {
+			log.Info("session ended", "duration", time.Since(session.Started), "rx_bytes", session.rxBytes.Load(), "tx_bytes", session.txBytes.Load())
+		}()
+
+		// Loop over read/write and forward packets to virtual interface.
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(cfg.SessionTimeout))
 		defer cancel()
 
 		netConn := websocket.NetConn(ctx, c, websocket.MessageBinary)
 
-		recvChan := make(chan []byte)
-		defer close(recvChan)
+		recvChan := make(chan []byte, sendQueueLen)
 
 		wg := new(sync.WaitGroup)
 		wg.Add(2)
@@ -258,22 +604,26 @@ func wsHandlerWrapper(dev *device.Device, wsChan chan WSMessage) func(http.Respo
 		// Read loop.
 		go func() {
 			defer wg.Done()
-			readBuf := make([]byte, 1500)
 			for {
+				// The bind may still be reading the previous datagram, so
+				// each one gets its own buffer.
+				readBuf := make([]byte, 1500)
 				n, err := netConn.Read(readBuf)
 				if err != nil {
 					cancel()
-					// DEBUG: log.Print(err)
+					log.Debug("websocket read ended", "err", err)
 					return
 				}
+				session.rxBytes.Add(uint64(n))
 
 				select {
-				case wsChan <- WSMessage{
+				case tunnel.wsChan <- WSMessage{
 					buff:     readBuf[:n],
-					endpoint: WSEndpoint(netip.MustParseAddrPort(r.RemoteAddr)),
+					endpoint: endpoint,
 					response: WSResponse{
-						data: recvChan,
-						ctx:  ctx,
+						data:    recvChan,
+						ctx:     ctx,
+						session: session,
 					},
 				}:
 				case <-ctx.Done():
@@ -288,12 +638,13 @@ func wsHandlerWrapper(dev *device.Device, wsChan chan WSMessage) func(http.Respo
 			for {
 				select {
 				case msg := <-recvChan:
-					_, err := netConn.Write(msg)
+					n, err := netConn.Write(msg)
 					if err != nil {
 						cancel()
-						// DEBUG: log.Print(err)
+						log.Debug("websocket write ended", "err", err)
 						return
 					}
+					session.txBytes.Add(uint64(n))
 				case <-ctx.Done():
 					return
 				}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/fs"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kraken/assets"
+)
+
+// Gallery names come straight from the file system, so the index page must
+// escape them in text, attributes and scripts alike.
+func TestIndexEscapesGalleryNames(t *testing.T) {
+	hostile := []string{
+		`"><img src=x onerror=alert(1)>`,
+		`' onmouseover='alert(1)`,
+		`<script>alert(1)<\script>`,
+		`javascript:alert(1)`,
+		`{{.Nonce}}`,
+	}
+
+	dir := t.TempDir()
+	index, err := fs.ReadFile(assets.FS, "index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "index.html"), index, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []string{"pub", "priv"} {
+		for _, name := range hostile {
+			collection := filepath.Join(dir, "gallery", sub, name)
+			err = os.MkdirAll(collection, 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(filepath.Join(collection, name+".jpg"), nil, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	cfg := defaultConfig()
+	cfg.AssetsDir = dir
+	reloader, err := NewReloader(cfg, nil, NewSessionTable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	securityHeadersWrapper(0, serveTemplate(reloader)).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	body := w.Body.String()
+
+	for _, injected := range []string{`"><img`, "<img src=x", "' onmouseover='", "<script>alert"} {
+		if strings.Contains(body, injected) {
+			t.Errorf("index contains unescaped %q", injected)
+		}
+	}
+	for _, escaped := range []string{"&lt;img src=x onerror=alert(1)&gt;", "&#39; onmouseover=&#39;alert(1)", "{{.Nonce}} Collection"} {
+		if !strings.Contains(body, escaped) {
+			t.Errorf("index is missing escaped name %q", escaped)
+		}
+	}
+
+	csp := w.Header().Get("Content-Security-Policy")
+	if !strings.Contains(csp, "'nonce-") {
+		t.Fatal("no CSP nonce")
+	}
+	if strings.Count(body, "<script nonce=") != 2 || strings.Contains(body, `nonce=""`) {
+		t.Error("inline scripts are missing their nonce")
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal Prometheus text exposition, enough for counters, gauges and
+// histograms without pulling in a client library.
+
+var (
+	sessionsActive      = newGauge("kraken_ws_sessions_active", "Websocket sessions currently open.")
+	peersAdded          = newCounter("kraken_peers_added_total", "Ephemeral peers added to the WireGuard devices.")
+	peersRemoved        = newCounter("kraken_peers_removed_total", "Peers removed from the WireGuard devices when their session ended.")
+	authFailures        = newCounter("kraken_auth_failures_total", "Requests to /ws or the index page without valid credentials.")
+	handshakeFailures   = newCounter("kraken_handshake_failures_total", "Websocket handshakes rejected by reason.", "reason")
+	puzzleDifficulty    = newGauge("kraken_puzzle_difficulty_bits", "Leading zero bits required by the latest admission puzzle.")
+	bindDatagrams       = newCounter("kraken_bind_datagrams_total", "WireGuard datagrams passed through the websocket bind.", "direction")
+	bindBytes           = newCounter("kraken_bind_bytes_total", "WireGuard bytes passed through the websocket bind.", "direction")
+	bindSendDrops       = newCounter("kraken_bind_send_drops_total", "Datagrams dropped because a session's send queue was full.")
+	bindShapedDrops     = newCounter("kraken_bind_shaped_drops_total", "Datagrams dropped by a session's bandwidth limit.", "direction")
+	quotaExceeded       = newCounter("kraken_quota_exceeded_total", "Sessions closed for using up a daily transfer quota.", "quota")
+	virtualRequests     = newCounter("kraken_virtual_requests_total", "Requests handled by the virtual file server.", "prefix", "code")
+	privateDenied       = newCounter("kraken_private_denied_total", "Private gallery requests denied by address.")
+	wsRejected          = newCounter("kraken_ws_rejected_total", "Websocket requests rejected before the upgrade by the limit or origin check they failed.", "limit")
+	wsLimit             = newGauge("kraken_ws_limit", "Configured websocket limits, 0 meaning unlimited. Rates are per minute.", "limit")
+	sessionDuration     = newHistogram("kraken_session_duration_seconds", "Lifetime of websocket sessions.", []float64{0.5, 1, 2.5, 5, 10, 30, 60, 300})
+	metricsRegistryLock sync.Mutex
+	metricsRegistry     []metric
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+func register(m metric) {
+	metricsRegistryLock.Lock()
+	defer metricsRegistryLock.Unlock()
+
+	metricsRegistry = append(metricsRegistry, m)
+}
+
+// Serve every registered metric in the text exposition format.
+func metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		metricsRegistryLock.Lock()
+		metrics := append([]metric(nil), metricsRegistry...)
+		metricsRegistryLock.Unlock()
+
+		for _, m := range metrics {
+			m.write(w)
+		}
+	})
+}
+
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d desc) header(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, kind)
+}
+
+// Render label values as {a="x",b="y"}.
+func (d desc) labelString(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", d.name, len(values), len(d.labels)))
+	}
+	if len(values) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, label := range d.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%s", label, strconv.Quote(values[i]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// A value per label combination.
+type series struct {
+	desc
+	mu     sync.Mutex // protects values
+	values map[string]float64
+}
+
+func (s *series) add(v float64, labelValues []string) {
+	key := s.labelString(labelValues)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.values[key] += v
+}
+
+func (s *series) writeValues(w io.Writer) {
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.values))
+	for k := range s.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", s.name, k, formatFloat(s.values[k]))
+	}
+	s.mu.Unlock()
+}
+
+type Counter struct {
+	series
+}
+
+func newCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{series{desc: desc{name, help, labels}, values: make(map[string]float64)}}
+	if len(labels) == 0 {
+		c.values[""] = 0
+	}
+	register(c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.add(1, labelValues)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.add(v, labelValues)
+}
+
+func (c *Counter) Value(labelValues ...string) float64 {
+	key := c.labelString(labelValues)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.values[key]
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.header(w, "counter")
+	c.writeValues(w)
+}
+
+type Gauge struct {
+	series
+}
+
+func newGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{series{desc: desc{name, help, labels}, values: make(map[string]float64)}}
+	if len(labels) == 0 {
+		g.values[""] = 0
+	}
+	register(g)
+	return g
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.add(v, labelValues)
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	key := g.labelString(labelValues)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.values[key] = v
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.header(w, "gauge")
+	g.writeValues(w)
+}
+
+type Histogram struct {
+	desc
+	mu      sync.Mutex // protects following fields
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{desc: desc{name: name, help: help}, buckets: buckets, counts: make([]uint64, len(buckets))}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) ObserveDuration(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.header(w, "histogram")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, upper := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(upper), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Records the status code and body size written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Websocket upgrades take over the connection.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer cannot be hijacked")
+	}
+	if r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Count virtual file server requests by top-level path and status.
+func virtualMetricsWrapper(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		prefix := "other"
+		for _, p := range []string{"/public/", "/private/"} {
+			if strings.HasPrefix(r.URL.Path, p) {
+				prefix = p
+			}
+		}
+		virtualRequests.Inc(prefix, strconv.Itoa(rec.status))
+	})
+}
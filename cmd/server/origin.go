@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Which pages may open a tunnel on /ws and under which host names. Patterns
+// use path.Match syntax, so *.example.com matches any subdomain.
+type OriginPolicy struct {
+	origins []string // origin hosts, or scheme://host to also match the scheme
+	hosts   []string // Host headers, with or without port
+	dev     bool     // also allow localhost origins and hosts
+}
+
+// Parse comma separated origin and host patterns.
+func parseOriginPolicy(origins, hosts string, dev bool) (*OriginPolicy, error) {
+	p := &OriginPolicy{origins: splitList(strings.ToLower(origins)), hosts: splitList(strings.ToLower(hosts)), dev: dev}
+	for _, pattern := range append(p.origins, p.hosts...) {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return nil, fmt.Errorf("allowed origin or host %q: %v", pattern, err)
+		}
+	}
+	return p, nil
+}
+
+func matchAny(patterns []string, names ...string) bool {
+	for _, pattern := range patterns {
+		for _, name := range names {
+			if ok, _ := path.Match(pattern, strings.ToLower(name)); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Whether host, with or without a port, is this machine.
+func isLocalhost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	addr, err := netip.ParseAddr(strings.Trim(host, "[]"))
+	return err == nil && addr.IsLoopback()
+}
+
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+var (
+	errHostNotAllowed   = errors.New("host not allowed")
+	errOriginNotAllowed = errors.New("origin not allowed")
+)
+
+// Check the Host and Origin headers of a websocket request. Requests without
+// an Origin come from native clients rather than a browser and only need an
+// allowed host. Origins with the request's host name are always allowed.
+func (p *OriginPolicy) Check(r *http.Request) error {
+	if len(p.hosts) > 0 && !matchAny(p.hosts, r.Host, hostname(r.Host)) && !(p.dev && isLocalhost(r.Host)) {
+		return fmt.Errorf("%w: %s", errHostNotAllowed, r.Host)
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("%w: %s", errOriginNotAllowed, origin)
+	}
+	// Proxies often pass on the host without its port, so same-origin
+	// requests are recognised by host name alone.
+	switch {
+	case strings.EqualFold(u.Hostname(), strings.Trim(hostname(r.Host), "[]")):
+	case matchAny(p.origins, u.Scheme+"://"+u.Host, u.Host, u.Hostname()):
+	case p.dev && isLocalhost(u.Host):
+	default:
+		return fmt.Errorf("%w: %s", errOriginNotAllowed, origin)
+	}
+	return nil
+}
+
+// Turn away websocket requests from other sites or to other hosts before
+// they cost a handshake.
+func originWrapper(policy *OriginPolicy, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := policy.Check(r)
+		if err != nil {
+			check := "origin"
+			if errors.Is(err, errHostNotAllowed) {
+				check = "host"
+			}
+			wsRejected.Inc(check)
+			logger.Info("rejected websocket request", "client", clientIP(r), "err", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginPolicyCheck(t *testing.T) {
+	strict, err := parseOriginPolicy("https://kraken.example.com,*.trusted.example", "kraken.example.com", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open, err := parseOriginPolicy("", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, err := parseOriginPolicy("", "kraken.example.com", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		policy *OriginPolicy
+		host   string
+		origin string
+		want   error
+	}{
+		{"native client", strict, "kraken.example.com", "", nil},
+		{"native client to other host", strict, "evil.example", "", errHostNotAllowed},
+		{"allowed host with port", strict, "kraken.example.com:8443", "", nil},
+		{"same origin", open, "kraken.example.com:8080", "http://kraken.example.com:8080", nil},
+		{"same origin behind proxy dropping port", open, "kraken.example.com", "http://kraken.example.com:8080", nil},
+		{"same origin ipv6", open, "[::1]", "http://[::1]:8080", nil},
+		{"same origin other case", open, "Kraken.Example.com", "http://kraken.example.com", nil},
+		{"cross origin", open, "kraken.example.com", "https://evil.example", errOriginNotAllowed},
+		{"wildcard origin", strict, "kraken.example.com", "https://app.trusted.example", nil},
+		{"wildcard origin suffix only", strict, "kraken.example.com", "https://trusted.example.evil", errOriginNotAllowed},
+		{"unparseable origin", strict, "kraken.example.com", "::", errOriginNotAllowed},
+		{"null origin", strict, "kraken.example.com", "null", errOriginNotAllowed},
+		{"dev localhost", dev, "localhost:8080", "http://localhost:3000", nil},
+		{"dev loopback", dev, "127.0.0.1:8080", "http://127.0.0.1:3000", nil},
+		{"localhost without dev", strict, "kraken.example.com", "http://localhost:3000", errOriginNotAllowed},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r.Host = tt.host
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		err := tt.policy.Check(r)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// Peers that persist across websocket sessions, declared in a wg-quick style file:
+//
+//	[Peer]
+//	Name = alice
+//	PublicKey = <base64>
+//	PresharedKey = <base64>
+//	AllowedIPs = fd00:ca7::10/128
+//	Groups = curators, staff
+//
+//	[Access]
+//	Path = /private/Flag/
+//	Groups = curators
+//	Peers = bob
+type RegisteredPeer struct {
+	Name         string
+	PublicKey    device.NoisePublicKey
+	PresharedKey *device.NoisePresharedKey
+	AllowedIPs   []netip.Prefix
+	Groups       []string
+}
+
+// Grants registered peers access to virtual paths under Path.
+type AccessRule struct {
+	Path   string
+	Peers  []string
+	Groups []string
+}
+
+type PeerConfig struct {
+	Peers []*RegisteredPeer
+	Rules []AccessRule
+}
+
+func loadPeerConfig(filename string) (*PeerConfig, error) {
+	if filename == "" {
+		return &PeerConfig{}, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config := &PeerConfig{}
+	var peer *RegisteredPeer
+	var rule *AccessRule
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+
+		switch strings.ToLower(line) {
+		case "[peer]":
+			peer, rule = &RegisteredPeer{}, nil
+			config.Peers = append(config.Peers, peer)
+			continue
+		case "[access]":
+			config.Rules = append(config.Rules, AccessRule{})
+			peer, rule = nil, &config.Rules[len(config.Rules)-1]
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key = value", filename, lineNum)
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+
+		switch {
+		case peer != nil:
+			err = peer.set(key, value)
+		case rule != nil:
+			err = rule.set(key, value)
+		default:
+			err = fmt.Errorf("%q outside of a section", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineNum, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	err = config.validate()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return config, nil
+}
+
+func (p *RegisteredPeer) set(key, value string) error {
+	switch key {
+	case "name":
+		p.Name = value
+	case "publickey":
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(b) != device.NoisePublicKeySize {
+			return fmt.Errorf("invalid public key %q", value)
+		}
+		copy(p.PublicKey[:], b)
+	case "presharedkey":
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(b) != device.NoisePresharedKeySize {
+			return fmt.Errorf("invalid preshared key")
+		}
+		p.PresharedKey = new(device.NoisePresharedKey)
+		copy(p.PresharedKey[:], b)
+	case "allowedips":
+		for _, s := range splitList(value) {
+			prefix, err := netip.ParsePrefix(s)
+			if err != nil {
+				return err
+			}
+			p.AllowedIPs = append(p.AllowedIPs, prefix.Masked())
+		}
+	case "groups":
+		p.Groups = append(p.Groups, splitList(value)...)
+	default:
+		return fmt.Errorf("unknown peer key %q", key)
+	}
+	return nil
+}
+
+func (r *AccessRule) set(key, value string) error {
+	switch key {
+	case "path":
+		r.Path = value
+	case "peers":
+		r.Peers = append(r.Peers, splitList(value)...)
+	case "groups":
+		r.Groups = append(r.Groups, splitList(value)...)
+	default:
+		return fmt.Errorf("unknown access key %q", key)
+	}
+	return nil
+}
+
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (c *PeerConfig) validate() error {
+	names := make(map[string]bool)
+	keys := make(map[device.NoisePublicKey]bool)
+	for _, p := range c.Peers {
+		if p.Name == "" {
+			return fmt.Errorf("peer without a name")
+		}
+		if names[p.Name] {
+			return fmt.Errorf("duplicate peer name %q", p.Name)
+		}
+		names[p.Name] = true
+		if p.PublicKey.IsZero() {
+			return fmt.Errorf("peer %q has no public key", p.Name)
+		}
+		if keys[p.PublicKey] {
+			return fmt.Errorf("peer %q reuses another peer's public key", p.Name)
+		}
+		keys[p.PublicKey] = true
+		if len(p.AllowedIPs) == 0 {
+			return fmt.Errorf("peer %q has no allowed IPs", p.Name)
+		}
+		for _, prefix := range p.AllowedIPs {
+			if other := c.overlapping(prefix, p); other != nil {
+				return fmt.Errorf("peers %q and %q have overlapping allowed IPs", p.Name, other.Name)
+			}
+		}
+	}
+	for _, r := range c.Rules {
+		if !strings.HasPrefix(r.Path, "/") {
+			return fmt.Errorf("access path %q must start with /", r.Path)
+		}
+		for _, name := range r.Peers {
+			if !names[name] {
+				return fmt.Errorf("access rule for %q references unknown peer %q", r.Path, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns a peer other than except whose allowed IPs overlap prefix.
+func (c *PeerConfig) overlapping(prefix netip.Prefix, except *RegisteredPeer) *RegisteredPeer {
+	for _, p := range c.Peers {
+		if p == except {
+			continue
+		}
+		for _, allowed := range p.AllowedIPs {
+			if allowed.Overlaps(prefix) {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// Reports whether prefix is reserved for a registered peer.
+func (c *PeerConfig) Reserved(prefix netip.Prefix) bool {
+	return c.overlapping(prefix, nil) != nil
+}
+
+func (c *PeerConfig) Lookup(key device.NoisePublicKey) *RegisteredPeer {
+	for _, p := range c.Peers {
+		if p.PublicKey == key {
+			return p
+		}
+	}
+	return nil
+}
+
+// Returns the registered peer that owns virtual address addr.
+func (c *PeerConfig) PeerFor(addr netip.Addr) *RegisteredPeer {
+	for _, p := range c.Peers {
+		if p.Owns(addr) {
+			return p
+		}
+	}
+	return nil
+}
+
+// Reports whether a rule grants peer access to path.
+func (c *PeerConfig) Allowed(peer *RegisteredPeer, path string) bool {
+	if peer == nil {
+		return false
+	}
+	for _, r := range c.Rules {
+		if !pathCovers(r.Path, path) {
+			continue
+		}
+		if contains(r.Peers, peer.Name) {
+			return true
+		}
+		for _, g := range peer.Groups {
+			if contains(r.Groups, g) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Whether a rule for prefix applies to path. Prefixes match whole path
+// segments, so /private/Flag covers /private/Flag/flag.jpg but not
+// /private/FlagBackup.
+func pathCovers(prefix, path string) bool {
+	return path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+func (p *RegisteredPeer) Owns(addr netip.Addr) bool {
+	for _, prefix := range p.AllowedIPs {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// UAPI configuration adding the peer to a device.
+func (p *RegisteredPeer) ipcConfig() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "public_key=%s\n", hex.EncodeToString(p.PublicKey[:]))
+	if p.PresharedKey != nil {
+		fmt.Fprintf(&b, "preshared_key=%s\n", hex.EncodeToString(p.PresharedKey[:]))
+	}
+	b.WriteString("replace_allowed_ips=true\n")
+	for _, prefix := range p.AllowedIPs {
+		fmt.Fprintf(&b, "allowed_ip=%v\n", prefix)
+	}
+	return b.String()
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestAllowedMatchesWholeSegments(t *testing.T) {
+	alice := &RegisteredPeer{Name: "alice"}
+	peers := &PeerConfig{
+		Peers: []*RegisteredPeer{alice},
+		Rules: []AccessRule{{Path: "/private/Flag", Peers: []string{"alice"}}},
+	}
+	for path, want := range map[string]bool{
+		"/private/Flag":             true,
+		"/private/Flag/":            true,
+		"/private/Flag/flag.jpg":    true,
+		"/private/FlagBackup/x.jpg": false,
+		"/private/Flag.jpg":         false,
+		"/private/":                 false,
+	} {
+		if got := peers.Allowed(alice, path); got != want {
+			t.Errorf("Allowed(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Addresses of reverse proxies whose X-Forwarded-For and X-Real-IP headers
+// are believed.
+type ProxyList []netip.Prefix
+
+// Parse a comma separated list of addresses and CIDR prefixes.
+func parseProxies(s string) (ProxyList, error) {
+	proxies := ProxyList{}
+	for _, entry := range splitList(s) {
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("trusted proxy: %v", err)
+			}
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy: %v", err)
+		}
+		proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return proxies, nil
+}
+
+func (p ProxyList) Trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// The address a request came from. Requests from a trusted proxy are
+// attributed to the nearest untrusted address in X-Forwarded-For, or failing
+// that to X-Real-IP. Returns the zero Addr if the listener doesn't report an
+// IP address, as with unix sockets.
+func (p ProxyList) ClientIP(r *http.Request) netip.Addr {
+	peerAddr, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	peer := peerAddr.Addr().Unmap()
+	if !p.Trusted(peer) {
+		return peer
+	}
+
+	// Later hops are appended, so walk back from the proxy that reached us.
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	client := peer
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		client = addr.Unmap()
+		if !p.Trusted(client) {
+			return client
+		}
+	}
+	if client != peer {
+		return client
+	}
+
+	addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP")))
+	if err == nil {
+		return addr.Unmap()
+	}
+	return peer
+}
+
+type clientIPContextKey struct{}
+
+// Resolve the real client address once for the handlers below.
+func realIPWrapper(proxies ProxyList, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPContextKey{}, proxies.ClientIP(r))
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Address used to attribute requests to a client.
+func clientIP(r *http.Request) netip.Addr {
+	if addr, ok := r.Context().Value(clientIPContextKey{}).(netip.Addr); ok {
+		return addr
+	}
+	return ProxyList(nil).ClientIP(r)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestProxyListClientIP(t *testing.T) {
+	proxies, err := parseProxies("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		peer      string
+		forwarded []string
+		realIP    string
+		want      string
+	}{
+		{"direct", "203.0.113.7:1234", nil, "", "203.0.113.7"},
+		{"untrusted peer spoofing", "203.0.113.7:1234", []string{"198.51.100.1"}, "198.51.100.2", "203.0.113.7"},
+		{"trusted proxy", "10.0.0.1:1234", []string{"203.0.113.7"}, "", "203.0.113.7"},
+		{"trusted single address", "192.0.2.1:1234", []string{"203.0.113.7"}, "", "203.0.113.7"},
+		{"client prepends a spoofed hop", "10.0.0.1:1234", []string{"198.51.100.1, 203.0.113.7"}, "", "203.0.113.7"},
+		{"trusted hops skipped", "10.0.0.1:1234", []string{"203.0.113.7, 10.0.0.5, 192.0.2.1"}, "", "203.0.113.7"},
+		{"repeated headers", "10.0.0.1:1234", []string{"203.0.113.7", "10.0.0.5"}, "", "203.0.113.7"},
+		{"only trusted hops", "10.0.0.1:1234", []string{"10.0.0.5"}, "", "10.0.0.5"},
+		{"malformed nearest hop", "10.0.0.1:1234", []string{"203.0.113.7, garbage"}, "198.51.100.9", "198.51.100.9"},
+		{"malformed behind trusted hop", "10.0.0.1:1234", []string{"garbage, 10.0.0.5"}, "198.51.100.9", "10.0.0.5"},
+		{"real ip fallback", "10.0.0.1:1234", nil, "203.0.113.7", "203.0.113.7"},
+		{"malformed real ip", "10.0.0.1:1234", nil, "garbage", "10.0.0.1"},
+		{"unix socket", "@", []string{"203.0.113.7"}, "203.0.113.7", ""},
+		{"mapped addresses", "[::ffff:10.0.0.1]:1234", []string{"::ffff:203.0.113.7"}, "", "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.peer
+		for _, header := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", header)
+		}
+		if tt.realIP != "" {
+			r.Header.Set("X-Real-IP", tt.realIP)
+		}
+		var want netip.Addr
+		if tt.want != "" {
+			want = netip.MustParseAddr(tt.want)
+		}
+		got := proxies.ClientIP(r)
+		if got != want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
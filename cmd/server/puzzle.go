@@ -0,0 +1,58 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// Hashes a second a slow client, the wasm build on a phone, manages.
+	// Difficulty is set so such a client meets the target time.
+	puzzleHashRate = 200000
+
+	// Most doublings of the work as the server fills up.
+	puzzleMaxExtraBits = 4
+
+	// Live sessions at which difficulty peaks when -max-sessions is unlimited.
+	puzzleDefaultCapacity = 512
+)
+
+// Sets the proof-of-work puzzle anonymous peers solve before admission,
+// harder the more sessions are live. A nil PuzzleGate issues no puzzles.
+type PuzzleGate struct {
+	base     int
+	capacity int
+	sessions *SessionTable
+}
+
+// Gate whose idle puzzle takes a slow client about target, or nil if target
+// is zero. capacity is the number of live sessions at which difficulty peaks.
+func NewPuzzleGate(target time.Duration, capacity int, sessions *SessionTable) *PuzzleGate {
+	if target <= 0 {
+		return nil
+	}
+	if capacity <= 0 {
+		capacity = puzzleDefaultCapacity
+	}
+	base := int(math.Log2(target.Seconds() * puzzleHashRate))
+	if base < 1 {
+		base = 1
+	}
+	return &PuzzleGate{base: base, capacity: capacity, sessions: sessions}
+}
+
+// Leading zero bits the next puzzle requires, zero for none.
+func (g *PuzzleGate) Difficulty() int {
+	if g == nil {
+		return 0
+	}
+	load := math.Min(1, float64(len(g.sessions.Sessions()))/float64(g.capacity))
+	difficulty := g.base + int(load*puzzleMaxExtraBits)
+	puzzleDifficulty.Set(float64(difficulty))
+	return difficulty
+}
+
+// About how long a slow client takes to solve a puzzle of difficulty.
+func puzzleSolveTime(difficulty int) time.Duration {
+	return time.Duration(math.Exp2(float64(difficulty)) / puzzleHashRate * float64(time.Second))
+}
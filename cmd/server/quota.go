@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+	"nhooyr.io/websocket"
+)
+
+// How often quota usage is written back to the quota file.
+const quotaSaveInterval = 30 * time.Second
+
+// Token bucket limiting a session's datagrams in one direction. A nil bucket
+// lets everything through.
+type byteBucket struct {
+	mu     sync.Mutex // protects following fields
+	rate   float64    // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Bucket passing rate bytes a second, or nil if rate is zero. Bursts of a
+// second's worth, and at least 64 KiB so a TCP window fits, pass at once.
+func newByteBucket(rate int) *byteBucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst := math.Max(float64(rate), 64*1024)
+	return &byteBucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Take n bytes' worth of tokens, or report that the datagram should be dropped.
+func (b *byteBucket) Allow(n int) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Bytes moved today, UTC, per peer key and per client address, as saved in
+// the quota file.
+type quotaUsage struct {
+	Day  string                `json:"day"`
+	Keys map[string]uint64     `json:"keys"`
+	IPs  map[netip.Addr]uint64 `json:"ips"`
+}
+
+// Daily transfer quotas. A nil QuotaTracker enforces nothing.
+type QuotaTracker struct {
+	filename string
+	perKey   uint64
+	perIP    uint64
+	mu       sync.Mutex // protects following fields
+	usage    quotaUsage
+	dirty    bool
+}
+
+// Track quotas of perKey and perIP bytes a day, zero meaning unlimited,
+// carrying on from filename if it exists. Returns nil if both are unlimited.
+func openQuotas(filename string, perKey, perIP uint64) (*QuotaTracker, error) {
+	if perKey == 0 && perIP == 0 {
+		return nil, nil
+	}
+
+	q := &QuotaTracker{filename: filename, perKey: perKey, perIP: perIP}
+	q.reset(today())
+	if filename == "" {
+		return q, nil
+	}
+	b, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var usage quotaUsage
+	err = json.Unmarshal(b, &usage)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	if usage.Day == q.usage.Day {
+		if usage.Keys != nil {
+			q.usage.Keys = usage.Keys
+		}
+		if usage.IPs != nil {
+			q.usage.IPs = usage.IPs
+		}
+	}
+	return q, nil
+}
+
+func today() string {
+	return time.Now().UTC().Format("2006-01-02")
+}
+
+// Time until quotas reset at midnight UTC.
+func untilQuotaReset() time.Duration {
+	now := time.Now().UTC()
+	y, m, d := now.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC).Sub(now)
+}
+
+// Callers hold q.mu.
+func (q *QuotaTracker) reset(day string) {
+	q.usage = quotaUsage{Day: day, Keys: make(map[string]uint64), IPs: make(map[netip.Addr]uint64)}
+	q.dirty = true
+}
+
+// Callers hold q.mu.
+func (q *QuotaTracker) rollover() {
+	if day := today(); day != q.usage.Day {
+		q.reset(day)
+	}
+}
+
+// Callers hold q.mu.
+func (q *QuotaTracker) check(key string, ip netip.Addr) error {
+	if q.perKey > 0 && q.usage.Keys[key] >= q.perKey {
+		return errKeyQuotaExceeded
+	}
+	if q.perIP > 0 && q.usage.IPs[ip] >= q.perIP {
+		return errIPQuotaExceeded
+	}
+	return nil
+}
+
+var (
+	errKeyQuotaExceeded = errors.New("daily transfer quota exceeded for this key")
+	errIPQuotaExceeded  = errors.New("daily transfer quota exceeded for this address")
+)
+
+// Whether key or ip has used up its quota for today.
+func (q *QuotaTracker) Check(key device.NoisePublicKey, ip netip.Addr) error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rollover()
+	return q.check(base64.StdEncoding.EncodeToString(key[:]), ip)
+}
+
+// Charge n bytes to key and ip, reporting a quota that is now used up.
+func (q *QuotaTracker) Add(key device.NoisePublicKey, ip netip.Addr, n int) error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rollover()
+	k := base64.StdEncoding.EncodeToString(key[:])
+	q.usage.Keys[k] += uint64(n)
+	q.usage.IPs[ip] += uint64(n)
+	q.dirty = true
+	return q.check(k, ip)
+}
+
+// Write usage to the quota file if it changed.
+func (q *QuotaTracker) Save() error {
+	if q == nil || q.filename == "" {
+		return nil
+	}
+	q.mu.Lock()
+	if !q.dirty {
+		q.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(q.usage)
+	q.dirty = false
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(q.filename, b)
+	if err != nil {
+		// Try again next time.
+		q.mu.Lock()
+		q.dirty = true
+		q.mu.Unlock()
+	}
+	return err
+}
+
+// Replace filename in one step so a crash never leaves half of it.
+func writeFileAtomic(filename string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// Save usage periodically.
+func (q *QuotaTracker) Run() {
+	if q == nil {
+		return
+	}
+	for range time.Tick(quotaSaveInterval) {
+		err := q.Save()
+		if err != nil {
+			logger.Error("saving quotas", "err", err)
+		}
+	}
+}
+
+// Charge n bytes through the bind to the session's quotas, closing the
+// session once one is used up.
+func (s *Session) charge(n int) {
+	err := s.quotas.Add(s.PublicKey, s.ClientIP, n)
+	if err == nil {
+		return
+	}
+	s.quotaOnce.Do(func() {
+		if err == errKeyQuotaExceeded {
+			quotaExceeded.Inc("key")
+		} else {
+			quotaExceeded.Inc("ip")
+		}
+		s.log.Info("closing session over quota", "err", err)
+		go s.conn.Close(websocket.StatusPolicyViolation, err.Error())
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io/fs"
+	"sync"
+	"sync/atomic"
+
+	"golang.zx2c4.com/wireguard/device"
+
+	"kraken/util"
+)
+
+// The parts of the server that can be replaced without dropping sessions.
+type State struct {
+	Gallery   Gallery
+	PublicFS  fs.FS // files behind Gallery.Public
+	PrivateFS fs.FS // files behind Gallery.Private
+	Template  *template.Template
+	Peers     *PeerConfig
+	LogLevel  util.LogLevel
+	LogFormat util.LogFormat
+	Auth      *Auth
+}
+
+// Rebuilds State from the configuration on SIGHUP or an admin request.
+type Reloader struct {
+	mu       sync.Mutex // serializes reloads
+	cfg      *Config
+	args     []string
+	state    atomic.Pointer[State]
+	keyring  Keyring
+	sessions *SessionTable
+}
+
+func NewReloader(cfg *Config, args []string, sessions *SessionTable) (*Reloader, error) {
+	r := &Reloader{cfg: cfg, args: args, sessions: sessions}
+	state, err := r.build(cfg)
+	if err != nil {
+		return nil, err
+	}
+	r.store(state)
+	return r, nil
+}
+
+func (r *Reloader) State() *State {
+	return r.state.Load()
+}
+
+func (r *Reloader) store(state *State) {
+	r.state.Store(state)
+	logger.SetLevel(state.LogLevel)
+	logger.SetFormat(state.LogFormat)
+}
+
+// Read the gallery, index template, peers and credential files into a new
+// State.
+func (r *Reloader) build(cfg *Config) (*State, error) {
+	tmpl, err := template.ParseFS(cfg.assetsFS(), "index.html")
+	if err != nil {
+		return nil, err
+	}
+	pub, priv := cfg.pubFS(), cfg.privFS()
+	publicImages, err := collectionsFromFS(pub)
+	if err != nil {
+		return nil, err
+	}
+	privateImages, err := collectionsFromFS(priv)
+	if err != nil {
+		return nil, err
+	}
+	peers, err := loadPeerConfig(cfg.PeersFile)
+	if err != nil {
+		return nil, err
+	}
+	logLevel, err := util.ParseLogLevel(cfg.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	logFormat, err := util.ParseLogFormat(cfg.LogFormat)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := loadAuth(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &State{
+		Gallery:   Gallery{Public: publicImages, Private: privateImages},
+		PublicFS:  pub,
+		PrivateFS: priv,
+		Template:  tmpl,
+		Peers:     peers,
+		LogLevel:  logLevel,
+		LogFormat: logFormat,
+		Auth:      auth,
+	}, nil
+}
+
+// Reload re-reads the configuration and swaps in the new state. The old state
+// stays in place if anything fails to load, would disturb a live session or is
+// rejected by WireGuard. Only the gallery, template, peers, logging settings
+// and credentials are reloaded; other settings need a restart.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, _, err := loadConfig(r.args)
+	if err != nil {
+		return err
+	}
+	state, err := r.build(cfg)
+	if err != nil {
+		return err
+	}
+
+	old := r.State()
+	for _, s := range r.sessions.Sessions() {
+		if old.Peers.Lookup(s.PublicKey) != nil {
+			continue
+		}
+		if state.Peers.Lookup(s.PublicKey) != nil || state.Peers.PeerFor(s.Addr) != nil {
+			return fmt.Errorf("ephemeral session for %v would be taken over by a registered peer", s.Addr)
+		}
+	}
+
+	// Configure the devices before the new state goes live, so a session
+	// never sees peers that WireGuard doesn't know about.
+	connected := make(map[device.NoisePublicKey]bool)
+	for _, s := range r.sessions.Sessions() {
+		connected[s.PublicKey] = true
+	}
+	for i, t := range r.keyring {
+		for _, peer := range state.Peers.Peers {
+			err = t.dev.IpcSet(peer.ipcConfig())
+			if err != nil {
+				for _, t := range r.keyring[:i+1] {
+					restorePeers(t, old.Peers, state.Peers, connected)
+				}
+				return fmt.Errorf("configuring peer %s: %w", peer.Name, err)
+			}
+		}
+	}
+
+	r.store(state)
+
+	// Registered peers that are still connected are removed when their
+	// session ends.
+	for _, t := range r.keyring {
+		for _, peer := range old.Peers.Peers {
+			if state.Peers.Lookup(peer.PublicKey) == nil && !connected[peer.PublicKey] {
+				t.dev.RemovePeer(peer.PublicKey)
+			}
+		}
+	}
+	return nil
+}
+
+// Undo a partly applied reload on t: peers from the old configuration get
+// their old settings back and peers it didn't have are removed again.
+func restorePeers(t *Tunnel, old, failed *PeerConfig, connected map[device.NoisePublicKey]bool) {
+	for _, peer := range failed.Peers {
+		if prev := old.Lookup(peer.PublicKey); prev != nil {
+			err := t.dev.IpcSet(prev.ipcConfig())
+			if err != nil {
+				logger.Error("restoring peer after failed reload", "peer", prev.Name, "err", err)
+			}
+		} else if !connected[peer.PublicKey] {
+			t.dev.RemovePeer(peer.PublicKey)
+		}
+	}
+}
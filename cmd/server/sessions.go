@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+	"nhooyr.io/websocket"
+
+	"kraken/util"
+)
+
+var (
+	errDraining  = errors.New("server is shutting down")
+	errAddrInUse = errors.New("virtual address in use")
+	errKeyInUse  = errors.New("public key in use by another session")
+)
+
+// A live websocket tunnel.
+type Session struct {
+	ID        string
+	PublicKey device.NoisePublicKey
+	Addr      netip.Addr
+	ClientIP  netip.Addr
+	Started   time.Time
+	tunnel    *Tunnel
+	conn      *websocket.Conn
+	log       *util.Logger
+	span      *Span
+	firstRx   *Span // ended by the bind when the first datagram arrives
+	rxBytes   atomic.Uint64
+	txBytes   atomic.Uint64
+	up        *byteBucket // shapes datagrams from the client
+	down      *byteBucket // shapes datagrams to the client
+	quotas    *QuotaTracker
+	quotaOnce sync.Once
+}
+
+// Tracks live sessions so shutdown can wait for them to finish.
+type SessionTable struct {
+	mu       sync.Mutex // protects following fields
+	sessions map[*Session]struct{}
+	draining bool
+	wg       sync.WaitGroup
+}
+
+func NewSessionTable() *SessionTable {
+	return &SessionTable{sessions: make(map[*Session]struct{})}
+}
+
+func (t *SessionTable) Draining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.draining
+}
+
+// Add registers a session unless the server has started draining or another
+// session already uses its virtual address or public key. Sessions with the
+// same key would share one WireGuard peer, which the first to end removes.
+func (t *SessionTable) Add(s *Session) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.draining {
+		return errDraining
+	}
+	for other := range t.sessions {
+		if other.Addr.Unmap() == s.Addr.Unmap() {
+			return errAddrInUse
+		}
+		if other.PublicKey == s.PublicKey {
+			return errKeyInUse
+		}
+	}
+	t.sessions[s] = struct{}{}
+	t.wg.Add(1)
+	sessionsActive.Add(1)
+	return nil
+}
+
+func (t *SessionTable) Sessions() []*Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sessions := make([]*Session, 0, len(t.sessions))
+	for s := range t.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// The session whose peer uses virtual address addr.
+func (t *SessionTable) ForAddr(addr netip.Addr) *Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for s := range t.sessions {
+		if s.Addr.Unmap() == addr.Unmap() {
+			return s
+		}
+	}
+	return nil
+}
+
+func (t *SessionTable) Get(id string) *Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for s := range t.sessions {
+		if s.ID == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// Tag wireguard-go log lines, which name peers as peer(abcd…wxyz), with the
+// matching session.
+func (t *SessionTable) deviceLogAttrs(msg string) []any {
+	_, rest, ok := strings.Cut(msg, "peer(")
+	if !ok {
+		return nil
+	}
+	short, _, ok := strings.Cut(rest, ")")
+	if !ok {
+		return nil
+	}
+	for _, s := range t.Sessions() {
+		key := base64.StdEncoding.EncodeToString(s.PublicKey[:])
+		if key[:4]+"…"+key[39:43] == short {
+			return []any{"session", s.ID}
+		}
+	}
+	return nil
+}
+
+func (t *SessionTable) Remove(s *Session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.sessions[s]; ok {
+		delete(t.sessions, s)
+		t.wg.Done()
+		sessionsActive.Add(-1)
+		sessionDuration.ObserveDuration(s.Started)
+	}
+}
+
+// Drain stops new sessions and waits for live ones to end or ctx to expire.
+func (t *SessionTable) Drain(ctx context.Context) error {
+	t.mu.Lock()
+	t.draining = true
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// CloseAll closes every remaining session's websocket.
+func (t *SessionTable) CloseAll(code websocket.StatusCode, reason string) int {
+	return closeSessions(t.Sessions(), code, reason)
+}
+
+// Kick closes the sessions matching f.
+func (t *SessionTable) Kick(f func(*Session) bool, reason string) int {
+	sessions := []*Session{}
+	for _, s := range t.Sessions() {
+		if f(s) {
+			sessions = append(sessions, s)
+		}
+	}
+	return closeSessions(sessions, websocket.StatusPolicyViolation, reason)
+}
+
+func closeSessions(sessions []*Session, code websocket.StatusCode, reason string) int {
+	// Closing waits for the client's close frame, so close them all at once.
+	wg := new(sync.WaitGroup)
+	for _, s := range sessions {
+		wg.Add(1)
+		go func(s *Session) {
+			defer wg.Done()
+			s.conn.Close(code, reason)
+		}(s)
+	}
+	wg.Wait()
+	return len(sessions)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// Time allowed for handlers and virtual requests to notice they were closed.
+const closeGracePeriod = 5 * time.Second
+
+// Stop accepting sessions, let live tunnels finish within the drain timeout,
+// close whatever is left, then tear down the virtual servers and devices.
+func shutdown(cfg *Config, server *http.Server, sessions *SessionTable, virtualServers []*http.Server, keyring Keyring) {
+	logger.Info("shutting down, draining sessions", "timeout", cfg.DrainTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.DrainTimeout))
+	defer cancel()
+
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := server.Shutdown(ctx)
+		if err != nil {
+			logger.Error("shutting down server", "err", err)
+			server.Close()
+		}
+	}()
+
+	err := sessions.Drain(ctx)
+	if err != nil {
+		n := sessions.CloseAll(websocket.StatusGoingAway, errDraining.Error())
+		logger.Warn("closed sessions still open after drain timeout", "sessions", n, "timeout", cfg.DrainTimeout)
+
+		graceCtx, graceCancel := context.WithTimeout(context.Background(), closeGracePeriod)
+		sessions.Drain(graceCtx)
+		graceCancel()
+	}
+	wg.Wait()
+
+	ctx, cancel = context.WithTimeout(context.Background(), closeGracePeriod)
+	defer cancel()
+	for _, vs := range virtualServers {
+		err = vs.Shutdown(ctx)
+		if err != nil {
+			logger.Error("shutting down virtual server", "err", err)
+			vs.Close()
+		}
+	}
+
+	for _, t := range keyring {
+		t.dev.Down()
+		t.dev.Close()
+	}
+	logger.Info("shutdown complete")
+}
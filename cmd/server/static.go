@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"kraken/assets"
+)
+
+// Static files for the index page, gzipped files from -compressed-dir if set
+// and otherwise the copies compiled into the binary.
+func staticHandler(cfg *Config) http.Handler {
+	if cfg.CompressedDir != "" {
+		return compressedWrapper(http.FileServer(CompressedDir{http.Dir(filepath.Join(cfg.CompressedDir, "static"))}))
+	}
+	static, err := newEmbeddedStatic()
+	if err != nil {
+		logger.Fatal("compressing embedded static files", "err", err)
+	}
+	return static
+}
+
+// Embedded static files, gzipped once at startup and sent compressed to
+// clients that accept it.
+type embeddedStatic struct {
+	gzipped map[string][]byte
+	plain   http.Handler
+}
+
+// Server start time, standing in for the embedded files' modification time.
+var embeddedModTime = time.Now()
+
+func newEmbeddedStatic() (*embeddedStatic, error) {
+	files, err := fs.Sub(assets.FS, "static")
+	if err != nil {
+		return nil, err
+	}
+	s := &embeddedStatic{gzipped: make(map[string][]byte), plain: http.FileServer(http.FS(files))}
+	err = fs.WalkDir(files, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := fs.ReadFile(files, name)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(b)
+		err = zw.Close()
+		if err != nil {
+			return err
+		}
+		s.gzipped[name] = buf.Bytes()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := s.gzipped["transfer.wasm"]; !ok {
+		logger.Warn("transfer.wasm is not embedded, build the wasm client before the server")
+	}
+	return s, nil
+}
+
+func (s *embeddedStatic) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	gz, ok := s.gzipped[name]
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !ok || !acceptsGzip(r) {
+		s.plain.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Type", mime.TypeByExtension(path.Ext(name)))
+	http.ServeContent(w, r, name, embeddedModTime, bytes.NewReader(gz))
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if strings.TrimSpace(enc) == "gzip" && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
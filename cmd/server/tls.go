@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// How often the certificate files are checked for changes.
+	certCheckInterval = 10 * time.Second
+
+	selfSignedValidity = 365 * 24 * time.Hour
+)
+
+// Serves the certificate in a pair of PEM files, loading it again when
+// either file changes so renewed certificates are picked up without a
+// restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.Mutex // protects following fields
+	cert     *tls.Certificate
+	modTime  time.Time // latest modification time of the two files
+	checked  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	err = c.load(modTime)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Callers hold c.mu, or have not shared c yet.
+func (c *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	c.checked = time.Now()
+	logger.Info("loaded tls certificate", "cert", c.certFile, "fingerprint", certFingerprint(&cert))
+	return nil
+}
+
+// The current certificate. A renewed certificate that fails to load is
+// logged and the old one kept.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) < certCheckInterval {
+		return c.cert, nil
+	}
+	c.checked = time.Now()
+	modTime, err := c.latestModTime()
+	if err == nil && !modTime.Equal(c.modTime) {
+		err = c.load(modTime)
+	}
+	if err != nil {
+		logger.Error("reloading tls certificate", "err", err)
+	}
+	return c.cert, nil
+}
+
+// Certificate for local use, valid for localhost, the loopback addresses and
+// this machine's host name. With certFile and keyFile set it is saved there
+// on first use and loaded from there afterwards, so clients can trust it.
+func selfSignedCert(certFile, keyFile string) (*tls.Certificate, error) {
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err == nil {
+			logger.Info("loaded self-signed tls certificate", "cert", certFile, "fingerprint", certFingerprint(&cert))
+			return &cert, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"kraken"}, CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	if certFile != "" && keyFile != "" {
+		err = os.WriteFile(keyFile, keyPEM, 0600)
+		if err == nil {
+			err = os.WriteFile(certFile, certPEM, 0644)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	logger.Warn("generated self-signed tls certificate", "cert", certFile, "hosts", template.DNSNames, "fingerprint", certFingerprint(&cert))
+	return &cert, nil
+}
+
+// SHA-256 of the leaf certificate, as shown by browsers.
+func certFingerprint(cert *tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
+
+// TLS settings for the physical listener, or nil to serve plain HTTP.
+func serverTLSConfig(cfg *Config) (*tls.Config, error) {
+	switch {
+	case cfg.TLSSelfSigned:
+		cert, err := selfSignedCert(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{*cert}, MinVersion: tls.VersionTLS12}, nil
+	case cfg.TLSCertFile != "":
+		certs, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}, nil
+	}
+	return nil, nil
+}
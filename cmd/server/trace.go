@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// OTLP span kinds and status codes.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+
+	statusOK    = 1
+	statusError = 2
+)
+
+// Writes finished spans to a file, one OTLP-JSON ExportTraceServiceRequest
+// per line. A nil Tracer still hands out span IDs but exports nothing.
+type Tracer struct {
+	mu sync.Mutex // serializes writes
+	f  *os.File
+}
+
+func openTracer(filename string) (*Tracer, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &Tracer{f: f}, nil
+}
+
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	return t.f.Close()
+}
+
+// Start a span under parent, or a new trace if parent is nil.
+func (t *Tracer) Start(name string, parent *Span, kind int, kv ...any) *Span {
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now(), attrs: kv}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		randomID(s.traceID[:])
+	}
+	randomID(s.spanID[:])
+	return s
+}
+
+func randomID(b []byte) {
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+}
+
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	mu       sync.Mutex // protects following fields
+	attrs    []any
+	status   int
+	message  string
+	ended    bool
+}
+
+func (s *Span) TraceID() string {
+	return hex.EncodeToString(s.traceID[:])
+}
+
+func (s *Span) SpanID() string {
+	return hex.EncodeToString(s.spanID[:])
+}
+
+func (s *Span) SetAttrs(kv ...any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attrs = append(s.attrs, kv...)
+}
+
+// Mark the span failed with err.
+func (s *Span) Fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status = statusError
+	s.message = err.Error()
+}
+
+// End the span and export it. Later calls do nothing.
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	if s.status == 0 {
+		s.status = statusOK
+	}
+	span := otlpSpan{
+		TraceID:    s.TraceID(),
+		SpanID:     s.SpanID(),
+		Name:       s.name,
+		Kind:       s.kind,
+		StartTime:  strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTime:    strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes: otlpAttributes(s.attrs),
+		Status:     otlpStatus{Code: s.status, Message: s.message},
+	}
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	s.mu.Unlock()
+
+	if s.tracer != nil {
+		s.tracer.export(span)
+	}
+}
+
+func (t *Tracer) export(span otlpSpan) {
+	req := otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: otlpAttributes([]any{"service.name", "kraken"})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "kraken"},
+			Spans: []otlpSpan{span},
+		}},
+	}}}
+	b, err := json.Marshal(req)
+	if err != nil {
+		logger.Error("encoding span", "err", err)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, err = t.f.Write(append(b, '\n'))
+	if err != nil {
+		logger.Error("writing span", "err", err)
+	}
+}
+
+// The OTLP-JSON encoding of ExportTraceServiceRequest.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID      string         `json:"traceId"`
+	SpanID       string         `json:"spanId"`
+	ParentSpanID string         `json:"parentSpanId,omitempty"`
+	Name         string         `json:"name"`
+	Kind         int            `json:"kind"`
+	StartTime    string         `json:"startTimeUnixNano"`
+	EndTime      string         `json:"endTimeUnixNano"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	Status       otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	String *string `json:"stringValue,omitempty"`
+	Int    *string `json:"intValue,omitempty"`
+	Bool   *bool   `json:"boolValue,omitempty"`
+}
+
+func otlpAttributes(kv []any) []otlpKeyValue {
+	attrs := []otlpKeyValue{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		var v otlpValue
+		switch value := kv[i+1].(type) {
+		case int:
+			s := strconv.Itoa(value)
+			v.Int = &s
+		case uint64:
+			s := strconv.FormatUint(value, 10)
+			v.Int = &s
+		case bool:
+			v.Bool = &value
+		default:
+			s := fmt.Sprint(value)
+			v.String = &s
+		}
+		attrs = append(attrs, otlpKeyValue{Key: fmt.Sprint(kv[i]), Value: v})
+	}
+	return attrs
+}
+
+type sessionContextKey struct{}
+
+// The websocket session a virtual request arrived through, if any.
+func sessionFromContext(ctx context.Context) *Session {
+	s, _ := ctx.Value(sessionContextKey{}).(*Session)
+	return s
+}
+
+// Attribute virtual requests to the session owning the peer's address and
+// trace them as children of its span.
+func traceWrapper(sessions *SessionTable, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, err := netip.ParseAddrPort(r.RemoteAddr)
+		if err != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		session := sessions.ForAddr(addr.Addr())
+		if session == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		span := tracer.Start("virtual request", session.span, spanKindServer,
+			"session.id", session.ID,
+			"http.method", r.Method,
+			"http.target", r.URL.Path,
+			"net.peer.ip", addr.Addr().String(),
+		)
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, session)))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.SetAttrs("http.status_code", rec.status)
+		if rec.status >= 400 {
+			span.Fail(fmt.Errorf("%d %s", rec.status, http.StatusText(rec.status)))
+		}
+	})
+}
@@ -3,14 +3,17 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
+	"flag"
 	"fmt"
 	"image"
 	"image/jpeg"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"net/netip"
@@ -20,6 +23,7 @@ import (
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/tun/netstack"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"nhooyr.io/websocket"
 
 	"kraken/util"
 )
@@ -27,14 +31,56 @@ import (
 const server = "kraken.chal.pwni.ng"
 
 func main() {
-	res, err := getFile("/private/Flag/flag.jpg", server)
+	pskString := flag.String("psk", os.Getenv("KRAKEN_PRESHARED_KEY"), "base64 preshared key configured on the server (default $KRAKEN_PRESHARED_KEY)")
+	token := flag.String("token", os.Getenv("KRAKEN_TOKEN"), "bearer token or invite for servers that require one (default $KRAKEN_TOKEN)")
+	useTLS := flag.Bool("tls", false, "reach the server over https:// and wss://")
+	caFile := flag.String("ca-file", "", "PEM file of CA certificates to trust instead of the system's, such as a self-signed server certificate; implies -tls")
+	signingKeyString := flag.String("signing-key", util.DiscoverySigningKey, "base64 ed25519 key that signs the server's discovery document")
+	logLevelString := flag.String("log-level", "info", "log level: debug, info, warn or error")
+	logFormatString := flag.String("log-format", "text", "log format: text or json")
+	flag.Parse()
+
+	logLevel, err := util.ParseLogLevel(*logLevelString)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logFormat, err := util.ParseLogFormat(*logFormatString)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logger := util.NewLogger(util.WriterSink(os.Stderr), logFormat, logLevel)
+
+	signingKey, err := util.ParseSigningKey(*signingKeyString)
+	if err != nil {
+		logger.Fatal("signing key", "err", err)
+	}
+
+	var psk []byte
+	if *pskString != "" {
+		psk, err = util.ParseKey(*pskString)
+		if err != nil {
+			logger.Fatal("preshared key", "err", err)
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if *useTLS || *caFile != "" {
+		tlsConfig, err = loadTLSConfig(*caFile)
+		if err != nil {
+			logger.Fatal("tls", "err", err)
+		}
+	}
+
+	res, err := getFile("/private/Flag/flag.jpg", server, psk, *token, signingKey, tlsConfig, logger)
+	if err != nil {
+		logger.Fatal("fetching flag", "err", err)
 	}
 
 	img, _, err := image.Decode(bytes.NewReader(res))
 	if err != nil {
-		log.Fatalln(err)
+		logger.Fatal("decoding flag", "err", err)
 	}
 
 	out, _ := os.Create("./flag.jpeg")
@@ -44,7 +90,25 @@ func main() {
 	fmt.Println("Flag written to flag.jpeg")
 }
 
-func getFile(filename string, hostname string) ([]byte, error) {
+// TLS settings trusting the certificates in caFile, or the system's if empty.
+func loadTLSConfig(caFile string) (*tls.Config, error) {
+	if caFile == "" {
+		return &tls.Config{}, nil
+	}
+	b, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", caFile)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// Fetch filename from the virtual file server, reaching the physical server
+// over TLS if tlsConfig is not nil.
+func getFile(filename string, hostname string, psk []byte, token string, signingKey ed25519.PublicKey, tlsConfig *tls.Config, logger *util.Logger) ([]byte, error) {
 	// Generate ephemeral keypair and format server's public key.
 	privKey, err := wgtypes.GeneratePrivateKey()
 	if err != nil {
@@ -54,7 +118,14 @@ func getFile(filename string, hostname string) ([]byte, error) {
 	if err != nil {
 		return []byte{}, err
 	}
-	serverPubKeyBytes, err := base64.StdEncoding.DecodeString(util.ServerPubKey)
+
+	// Discover the server's keys and virtual network parameters.
+	transport := &http.Transport{TLSClientConfig: tlsConfig}
+	discovery, err := util.FetchDiscovery(&http.Client{Transport: transport, Timeout: 5 * time.Second}, hostname, tlsConfig != nil, signingKey)
+	if err != nil {
+		return []byte{}, err
+	}
+	serverPubKeyBytes, err := util.ParseKey(discovery.Keys[0])
 	if err != nil {
 		return []byte{}, err
 	}
@@ -66,22 +137,35 @@ func getFile(filename string, hostname string) ([]byte, error) {
 	tun, tnet, err := netstack.CreateNetTUN(
 		[]netip.Addr{ephemAddr},
 		[]netip.Addr{},
-		util.MTU)
+		discovery.MTU)
 	if err != nil {
 		return []byte{}, err
 	}
-	dev := device.NewDevice(tun, NewWSBind(privKey.PublicKey().String(), ephemAddr, hostname), device.NewLogger(device.LogLevelVerbose, ""))
+	// The token goes in a header so it stays out of access logs.
+	dialOpts := &websocket.DialOptions{HTTPClient: &http.Client{Transport: transport}}
+	if token != "" {
+		dialOpts.HTTPHeader = http.Header{"Authorization": {"Bearer " + token}}
+	}
+	bind := util.NewClientBind(privKey, serverPubKeyBytes, psk, ephemAddr, discovery.EndpointURL(hostname, tlsConfig != nil), dialOpts, logger)
+	dev := device.NewDevice(tun, bind, logger.DeviceLogger(bind.DeviceLogAttrs))
 	defer dev.Close()
 
-	dev.IpcSet(fmt.Sprintf(`private_key=%s
+	// The websocket bind ignores the endpoint, WireGuard just needs one to send to.
+	config := fmt.Sprintf(`private_key=%s
 public_key=%s
-endpoint=[::]:%d
+endpoint=[::]:0
 allowed_ip=::/0
 `,
 		hex.EncodeToString(privKeyBytes),
 		hex.EncodeToString(serverPubKeyBytes),
-		util.ServerPhysicalPort,
-	))
+	)
+	if psk != nil {
+		config += fmt.Sprintf("preshared_key=%s\n", hex.EncodeToString(psk))
+	}
+	err = dev.IpcSet(config)
+	if err != nil {
+		return []byte{}, fmt.Errorf("configuring device: %v", err)
+	}
 
 	err = dev.Up()
 	if err != nil {
@@ -94,9 +178,13 @@ allowed_ip=::/0
 		},
 		Timeout: 5 * time.Second,
 	}
-	url := fmt.Sprintf("http://%s/%s", net.JoinHostPort(util.ServerVirtualAddress, fmt.Sprint(fmt.Sprint(util.ServerVirtualPort))), filename)
+	url := fmt.Sprintf("http://%s/%s", net.JoinHostPort(discovery.VirtualAddress, fmt.Sprint(discovery.VirtualPort)), filename)
 	resp, err := client.Get(url)
 	if err != nil {
+		// Report why the server turned us away rather than a timeout.
+		if bindErr := bind.Err(); bindErr != nil {
+			return []byte{}, bindErr
+		}
 		return []byte{}, err
 	}
 
@@ -11,6 +11,7 @@ import (
 	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
 	"path/filepath"
 	"syscall/js"
 	"time"
@@ -27,7 +28,7 @@ func main() {
 	<-make(chan struct{})
 }
 
-func getFile(filename string, hostname string) ([]byte, error) {
+func getFile(filename string, hostname string, psk []byte, logger *util.Logger) ([]byte, error) {
 	// Generate ephemeral keypair and format server's public key.
 	privKey, err := wgtypes.GeneratePrivateKey()
 	if err != nil {
@@ -37,35 +38,58 @@ func getFile(filename string, hostname string) ([]byte, error) {
 	if err != nil {
 		return []byte{}, err
 	}
-	serverPubKeyBytes, err := base64.StdEncoding.DecodeString(util.ServerPubKey)
+
+	// Discover the server's keys and virtual network parameters.
+	signingKey, err := util.ParseSigningKey(util.DiscoverySigningKey)
+	if err != nil {
+		return []byte{}, err
+	}
+	// Reach the server the way the page was loaded, since browsers block
+	// ws:// from an https:// page.
+	secure := js.Global().Get("location").Get("protocol").String() == "https:"
+	discovery, err := util.FetchDiscovery(&http.Client{Timeout: 5 * time.Second}, hostname, secure, signingKey)
+	if err != nil {
+		return []byte{}, err
+	}
+	serverPubKeyBytes, err := util.ParseKey(discovery.Keys[0])
 	if err != nil {
 		return []byte{}, err
 	}
 
 	// Make ephemeral ipv6 address.
 	ephemAddr, err := generateAddr()
+	if err != nil {
+		return []byte{}, err
+	}
 
 	// Make virtual device.
 	tun, tnet, err := netstack.CreateNetTUN(
 		[]netip.Addr{ephemAddr},
 		[]netip.Addr{},
-		util.MTU)
+		discovery.MTU)
 	if err != nil {
 		return []byte{}, err
 	}
-	// DEBUG: dev := device.NewDevice(tun, NewWSBind(privKey.PublicKey().String(), ephemAddr, hostname), device.NewLogger(device.LogLevelVerbose, ""))
-	dev := device.NewDevice(tun, NewWSBind(privKey.PublicKey().String(), ephemAddr, hostname), device.NewLogger(device.LogLevelSilent, ""))
+	bind := util.NewClientBind(privKey, serverPubKeyBytes, psk, ephemAddr, discovery.EndpointURL(hostname, secure), nil, logger)
+	dev := device.NewDevice(tun, bind, logger.DeviceLogger(bind.DeviceLogAttrs))
 	defer dev.Close()
 
-	dev.IpcSet(fmt.Sprintf(`private_key=%s
+	// The websocket bind ignores the endpoint, WireGuard just needs one to send to.
+	config := fmt.Sprintf(`private_key=%s
 public_key=%s
-endpoint=[::]:%d
+endpoint=[::]:0
 allowed_ip=::/0
 `,
 		hex.EncodeToString(privKeyBytes),
 		hex.EncodeToString(serverPubKeyBytes),
-		util.ServerPhysicalPort,
-	))
+	)
+	if psk != nil {
+		config += fmt.Sprintf("preshared_key=%s\n", hex.EncodeToString(psk))
+	}
+	err = dev.IpcSet(config)
+	if err != nil {
+		return []byte{}, fmt.Errorf("configuring device: %v", err)
+	}
 
 	err = dev.Up()
 	if err != nil {
@@ -78,9 +102,14 @@ allowed_ip=::/0
 		},
 		Timeout: 5 * time.Second,
 	}
-	url := fmt.Sprintf("http://%s/%s", net.JoinHostPort(util.ServerVirtualAddress, fmt.Sprint(fmt.Sprint(util.ServerVirtualPort))), filename)
-	resp, err := client.Get(url)
+	// Names come from the gallery's directory listing and may need escaping.
+	fileURL := url.URL{Scheme: "http", Host: net.JoinHostPort(discovery.VirtualAddress, fmt.Sprint(discovery.VirtualPort)), Path: filename}
+	resp, err := client.Get(fileURL.String())
 	if err != nil {
+		// Report why the server turned us away rather than a timeout.
+		if bindErr := bind.Err(); bindErr != nil {
+			return []byte{}, bindErr
+		}
 		return []byte{}, err
 	}
 
@@ -107,32 +136,77 @@ func generateAddr() (netip.Addr, error) {
 	return netip.AddrFrom16(*(*[16]byte)(b)), nil
 }
 
+// Log to the browser console with the method matching each level.
+func consoleSink(level util.LogLevel, line string) {
+	method := "log"
+	switch level {
+	case util.LevelDebug:
+		method = "debug"
+	case util.LevelWarn:
+		method = "warn"
+	case util.LevelError:
+		method = "error"
+	}
+	js.Global().Get("console").Call(method, line)
+}
+
+// getFile(filename, hostname[, options]) returns a promise of
+// {name, type, data}: the file's base name without extension, its sniffed
+// MIME type and its contents in base64.
 func getFileWrapper() js.Func {
 	return js.FuncOf(func(this js.Value, args []js.Value) any {
 		filename := args[0].String()
 		hostname := args[1].String()
 
+		// Optional third argument: {presharedKey: "<base64>", logLevel: "debug",
+		// logFormat: "json"}. Servers that gate /ws are passed the login
+		// cookie set when the page loaded.
+		var psk []byte
+		logLevel, logFormat := util.LevelInfo, util.FormatText
+		if len(args) > 2 && args[2].Type() == js.TypeObject {
+			var err error
+			if key := args[2].Get("presharedKey"); key.Type() == js.TypeString && key.String() != "" {
+				psk, err = util.ParseKey(key.String())
+				if err != nil {
+					return js.Global().Get("Promise").Call("reject", js.Global().Get("Error").New("preshared key: "+err.Error()))
+				}
+			}
+			if level := args[2].Get("logLevel"); level.Type() == js.TypeString {
+				logLevel, err = util.ParseLogLevel(level.String())
+				if err != nil {
+					return js.Global().Get("Promise").Call("reject", js.Global().Get("Error").New(err.Error()))
+				}
+			}
+			if format := args[2].Get("logFormat"); format.Type() == js.TypeString {
+				logFormat, err = util.ParseLogFormat(format.String())
+				if err != nil {
+					return js.Global().Get("Promise").Call("reject", js.Global().Get("Error").New(err.Error()))
+				}
+			}
+		}
+		logger := util.NewLogger(consoleSink, logFormat, logLevel).With("file", filename)
+
 		handler := js.FuncOf(func(this js.Value, args []js.Value) any {
 			resolve, reject := args[0], args[1]
 
 			go func() {
-				contents, err := getFile(filename, hostname)
+				contents, err := getFile(filename, hostname, psk, logger)
 				if err != nil {
+					logger.Error("fetching file", "err", err)
 					errorConstructor := js.Global().Get("Error")
 					errorObject := errorConstructor.New(err.Error())
 					reject.Invoke(errorObject)
 					return
 				}
 
+				// Hand back data rather than markup so the page decides how
+				// to show it and nothing from the server is parsed as HTML.
 				base := filepath.Base(filename)
-				base = base[:len(base)-len(filepath.Ext(base))]
-
-				switch filepath.Ext(filename) {
-				case ".png", ".jpg":
-					resolve.Invoke(fmt.Sprintf("<figure>\n<img alt=%s src=\"data:image/png;base64,%s\">\n<figcaption><i>%s</i></figcaption>\n</figure>", base, base64.StdEncoding.EncodeToString(contents), base))
-				default:
-					resolve.Invoke(string(contents))
-				}
+				resolve.Invoke(map[string]any{
+					"name": base[:len(base)-len(filepath.Ext(base))],
+					"type": http.DetectContentType(contents),
+					"data": base64.StdEncoding.EncodeToString(contents),
+				})
 			}()
 
 			return nil
@@ -3,6 +3,7 @@ module kraken
 go 1.19
 
 require (
+	golang.org/x/crypto v0.6.0
 	golang.zx2c4.com/wireguard v0.0.0-20230209153558-1e2c3e5a3c14
 	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20221104135756-97bc4ad4a1cb
 	nhooyr.io/websocket v1.8.7
@@ -11,7 +12,6 @@ require (
 require (
 	github.com/google/btree v1.0.1 // indirect
 	github.com/klauspost/compress v1.11.13 // indirect
-	golang.org/x/crypto v0.6.0 // indirect
 	golang.org/x/net v0.6.0 // indirect
 	golang.org/x/sys v0.5.0 // indirect
 	golang.org/x/time v0.0.0-20191024005414-555d28b269f0 // indirect
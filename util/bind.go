@@ -0,0 +1,225 @@
+// Adapted from https://git.zx2c4.com/wireguard-go/tree/conn/bind_std.go?id=bb719d3a6e2c#n28
+package util
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"nhooyr.io/websocket"
+)
+
+// The client end of the websocket tunnel, shared by the wasm client and the
+// solution.
+type ClientBind struct {
+	mu          sync.Mutex // protects following fields
+	wsConn      net.Conn
+	connCreated chan bool
+	ctx         context.Context
+	cancel      context.CancelFunc
+	endpoint    conn.Endpoint
+	privKey     wgtypes.Key
+	serverPub   []byte
+	psk         []byte
+	err         error
+	clientAddr  netip.Addr
+	serverURL   string
+	dialOpts    *websocket.DialOptions
+	log         *Logger
+	session     atomic.Pointer[string] // assigned by the server during the handshake
+}
+
+// NewClientBind returns a bind that tunnels WireGuard over a websocket to
+// serverURL. dialOpts, which may be nil, carry anything the dial needs beyond
+// the URL, such as credentials or TLS settings.
+func NewClientBind(privKey wgtypes.Key, serverPub []byte, psk []byte, clientAddr netip.Addr, serverURL string, dialOpts *websocket.DialOptions, logger *Logger) *ClientBind {
+	return &ClientBind{connCreated: make(chan bool, 1), privKey: privKey, serverPub: serverPub, psk: psk, clientAddr: clientAddr, serverURL: serverURL, dialOpts: dialOpts, log: logger}
+}
+
+type ClientEndpoint netip.AddrPort
+
+var (
+	_ conn.Bind     = (*ClientBind)(nil)
+	_ conn.Endpoint = ClientEndpoint{}
+)
+
+func (*ClientBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	e, err := netip.ParseAddrPort(s)
+	return asEndpoint(e), err
+}
+
+func (*ClientBind) SetMark(mark uint32) error {
+	return nil
+}
+
+func (ClientEndpoint) ClearSrc() {}
+
+func (e ClientEndpoint) DstIP() netip.Addr {
+	return (netip.AddrPort)(e).Addr()
+}
+
+func (e ClientEndpoint) SrcIP() netip.Addr {
+	return netip.Addr{} // not supported
+}
+
+func (e ClientEndpoint) DstToBytes() []byte {
+	b, _ := (netip.AddrPort)(e).MarshalBinary()
+	return b
+}
+
+func (e ClientEndpoint) DstToString() string {
+	return (netip.AddrPort)(e).String()
+}
+
+func (e ClientEndpoint) SrcToString() string {
+	return ""
+}
+
+func (bind *ClientBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+
+	bind.ctx, bind.cancel = context.WithTimeout(context.Background(), time.Minute)
+	return []conn.ReceiveFunc{bind.makeReceiveWS()}, port, nil
+}
+
+func (bind *ClientBind) Close() error {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+
+	// Also wakes receivers still waiting for a connection that never came.
+	if bind.cancel != nil {
+		defer bind.cancel()
+	}
+
+	if bind.wsConn != nil {
+		err := bind.wsConn.Close()
+		if err != nil {
+			return err
+		}
+		bind.wsConn = nil
+	}
+
+	return nil
+}
+
+func (bind *ClientBind) makeReceiveWS() conn.ReceiveFunc {
+	return func(buff []byte) (int, conn.Endpoint, error) {
+		if bind.wsConn == nil {
+			select {
+			case <-bind.connCreated:
+			case <-bind.ctx.Done():
+				return 0, ClientEndpoint{}, net.ErrClosed
+			}
+		}
+
+		n, err := bind.wsConn.Read(buff)
+		var closeErr websocket.CloseError
+		if errors.As(err, &closeErr) && closeErr.Code != websocket.StatusNormalClosure {
+			bind.mu.Lock()
+			bind.err = fmt.Errorf("session closed: %s", closeErr.Reason)
+			bind.mu.Unlock()
+		}
+		return n, bind.endpoint, err
+	}
+}
+
+func (bind *ClientBind) Send(buff []byte, endpoint conn.Endpoint) error {
+	if bind.wsConn == nil {
+		err := bind.connect(endpoint)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := bind.wsConn.Write(buff)
+	return err
+}
+
+// Dial the server and complete the handshake before any packets are sent.
+func (bind *ClientBind) connect(endpoint conn.Endpoint) error {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+
+	if bind.wsConn != nil {
+		return nil
+	}
+
+	dialURL := fmt.Sprintf("%s?pub=%s&addr=%s&server=%s", bind.serverURL, Base64KeyToUrl(bind.privKey.PublicKey().String()), bind.clientAddr.String(), base64.RawURLEncoding.EncodeToString(bind.serverPub))
+	c, _, err := websocket.Dial(bind.ctx, dialURL, bind.dialOpts)
+	if err != nil {
+		bind.log.Warn("dial failed", "url", bind.serverURL, "err", err)
+		bind.err = err
+		return err
+	}
+
+	session, err := ClientHandshake(bind.ctx, c, bind.privKey, bind.serverPub, bind.psk, bind.log)
+	if err != nil {
+		bind.log.Warn("handshake failed", "err", err)
+		c.Close(websocket.StatusNormalClosure, "")
+		bind.err = err
+		return err
+	}
+	bind.session.Store(&session)
+	bind.log.Info("connected", "url", bind.serverURL, "addr", bind.clientAddr, "session", bind.Session())
+
+	bind.wsConn = websocket.NetConn(bind.ctx, c, websocket.MessageBinary)
+
+	bind.endpoint = endpoint
+	bind.connCreated <- true
+	return nil
+}
+
+// Session returns the ID the server gave this tunnel, which its logs use too.
+func (bind *ClientBind) Session() string {
+	if s := bind.session.Load(); s != nil {
+		return *s
+	}
+	return ""
+}
+
+// Tag device log lines with the session ID.
+func (bind *ClientBind) DeviceLogAttrs(msg string) []any {
+	if s := bind.Session(); s != "" {
+		return []any{"session", s}
+	}
+	return nil
+}
+
+// Err returns why the server last turned the tunnel away or closed it, if it
+// did.
+func (bind *ClientBind) Err() error {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+
+	return bind.err
+}
+
+// endpointPool contains a re-usable set of mapping from netip.AddrPort to Endpoint.
+// This exists to reduce allocations: Putting a netip.AddrPort in an Endpoint allocates,
+// but Endpoints are immutable, so we can re-use them.
+var endpointPool = sync.Pool{
+	New: func() any {
+		return make(map[netip.AddrPort]conn.Endpoint)
+	},
+}
+
+// asEndpoint returns an Endpoint containing ap.
+func asEndpoint(ap netip.AddrPort) conn.Endpoint {
+	m := endpointPool.Get().(map[netip.AddrPort]conn.Endpoint)
+	defer endpointPool.Put(m)
+	e, ok := m[ap]
+	if !ok {
+		e = conn.Endpoint(ClientEndpoint(ap))
+		m[ap] = e
+	}
+	return e
+}
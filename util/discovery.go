@@ -0,0 +1,137 @@
+package util
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// Path where the physical server publishes its signed configuration.
+	DiscoveryPath = "/.well-known/kraken.json"
+
+	// Long-term key that signs discovery documents. Only this key is compiled
+	// into clients; everything else is learned at runtime.
+	DiscoverySigningKey = "+X7d/CAxl63JiDTctHrSv4JG8VfpYOf73YtVVEOOm1s="
+
+	DiscoveryVersion = 1
+	ProtocolVersion  = 1
+)
+
+// Everything a client needs to reach the virtual file server.
+type Discovery struct {
+	Version        int       `json:"version"`
+	Issued         time.Time `json:"issued"`
+	Expires        time.Time `json:"expires"`
+	Keys           []string  `json:"keys"` // base64 server public keys, preferred first
+	VirtualAddress string    `json:"virtual_address"`
+	VirtualPort    int       `json:"virtual_port"`
+	MTU            int       `json:"mtu"`
+	Endpoints      []string  `json:"endpoints"` // websocket URLs or paths on the physical server
+	Protocols      []int     `json:"protocols"`
+}
+
+// A Discovery document as published, with an ed25519 signature over the
+// exact payload bytes.
+type SignedDiscovery struct {
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"signature"`
+}
+
+func SignDiscovery(d Discovery, key ed25519.PrivateKey) (SignedDiscovery, error) {
+	payload, err := json.Marshal(d)
+	if err != nil {
+		return SignedDiscovery{}, err
+	}
+
+	return SignedDiscovery{Payload: payload, Signature: ed25519.Sign(key, payload)}, nil
+}
+
+// Verify checks the signature and that the document is current and usable
+// by this client.
+func (s SignedDiscovery) Verify(trusted ed25519.PublicKey) (Discovery, error) {
+	d := Discovery{}
+	if !ed25519.Verify(trusted, s.Payload, s.Signature) {
+		return d, errors.New("discovery: bad signature")
+	}
+	err := json.Unmarshal(s.Payload, &d)
+	if err != nil {
+		return d, err
+	}
+
+	switch {
+	case d.Version != DiscoveryVersion:
+		return d, fmt.Errorf("discovery: unsupported document version %d", d.Version)
+	case time.Now().After(d.Expires):
+		return d, errors.New("discovery: document expired")
+	case !containsInt(d.Protocols, ProtocolVersion):
+		return d, fmt.Errorf("discovery: server does not support protocol version %d", ProtocolVersion)
+	case len(d.Keys) == 0 || len(d.Endpoints) == 0:
+		return d, errors.New("discovery: document lists no keys or endpoints")
+	case d.MTU <= 0 || d.VirtualPort <= 0:
+		return d, errors.New("discovery: invalid virtual network parameters")
+	}
+	return d, nil
+}
+
+// Websocket URL of the preferred endpoint, resolving paths against hostname
+// over wss:// if secure and ws:// otherwise.
+func (d Discovery) EndpointURL(hostname string, secure bool) string {
+	endpoint := d.Endpoints[0]
+	if strings.HasPrefix(endpoint, "/") {
+		scheme := "ws"
+		if secure {
+			scheme = "wss"
+		}
+		return fmt.Sprintf("%s://%s%s", scheme, hostname, endpoint)
+	}
+	return endpoint
+}
+
+// ParseSigningKey decodes a base64 ed25519 public key.
+func ParseSigningKey(key string) (ed25519.PublicKey, error) {
+	keyBytes, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(keyBytes) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid signing key")
+	}
+
+	return ed25519.PublicKey(keyBytes), nil
+}
+
+// FetchDiscovery downloads the physical server's discovery document, over
+// HTTPS if secure, and verifies it against trusted.
+func FetchDiscovery(client *http.Client, hostname string, secure bool, trusted ed25519.PublicKey) (Discovery, error) {
+	scheme := "http"
+	if secure {
+		scheme = "https"
+	}
+	resp, err := client.Get(fmt.Sprintf("%s://%s%s", scheme, hostname, DiscoveryPath))
+	if err != nil {
+		return Discovery{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Discovery{}, fmt.Errorf("discovery: %s", resp.Status)
+	}
+	signed := SignedDiscovery{}
+	err = json.NewDecoder(resp.Body).Decode(&signed)
+	if err != nil {
+		return Discovery{}, err
+	}
+	return signed.Verify(trusted)
+}
+
+func containsInt(list []int, n int) bool {
+	for _, item := range list {
+		if item == n {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package util
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedDiscoveryVerify(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := Discovery{
+		Version:        DiscoveryVersion,
+		Issued:         time.Now().Add(-time.Hour),
+		Expires:        time.Now().Add(time.Hour),
+		Keys:           []string{"WkABZvrXyuwM1L4aUIYlRoOkp7/4grDwiNp3aI3fcQU="},
+		VirtualAddress: "fd00::1",
+		VirtualPort:    80,
+		MTU:            1420,
+		Endpoints:      []string{"/ws"},
+		Protocols:      []int{ProtocolVersion},
+	}
+	sign := func(d Discovery, key ed25519.PrivateKey) SignedDiscovery {
+		signed, err := SignDiscovery(d, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	with := func(edit func(*Discovery)) SignedDiscovery {
+		d := valid
+		edit(&d)
+		return sign(d, key)
+	}
+
+	good := sign(valid, key)
+	tampered := sign(valid, key)
+	tampered.Payload = []byte(strings.Replace(string(tampered.Payload), `"/ws"`, `"wss://evil.example/ws"`, 1))
+	truncated := sign(valid, key)
+	truncated.Signature = truncated.Signature[:ed25519.SignatureSize-1]
+
+	tests := []struct {
+		name    string
+		signed  SignedDiscovery
+		trusted ed25519.PublicKey
+		err     string
+	}{
+		{"good", good, pub, ""},
+		{"tampered payload", tampered, pub, "bad signature"},
+		{"truncated signature", truncated, pub, "bad signature"},
+		{"checked with another key", good, otherPub, "bad signature"},
+		{"signed with another key", sign(valid, otherKey), pub, "bad signature"},
+		{"expired", with(func(d *Discovery) { d.Expires = time.Now().Add(-time.Second) }), pub, "expired"},
+		{"unsupported version", with(func(d *Discovery) { d.Version = DiscoveryVersion + 1 }), pub, "unsupported document version"},
+		{"unsupported protocol", with(func(d *Discovery) { d.Protocols = []int{ProtocolVersion + 1} }), pub, "protocol version"},
+		{"no keys", with(func(d *Discovery) { d.Keys = nil }), pub, "no keys or endpoints"},
+		{"no mtu", with(func(d *Discovery) { d.MTU = 0 }), pub, "invalid virtual network"},
+	}
+	for _, tt := range tests {
+		d, err := tt.signed.Verify(tt.trusted)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err == "" && d.EndpointURL("kraken.example", true) != "wss://kraken.example/ws":
+			t.Errorf("%s: got endpoint %s", tt.name, d.EndpointURL("kraken.example", true))
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got %v, want an error containing %q", tt.name, err, tt.err)
+		}
+	}
+}
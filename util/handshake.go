@@ -0,0 +1,190 @@
+package util
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"runtime"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// Messages exchanged over the websocket before the server registers a peer.
+// The server sends a Challenge, the client answers with a ChallengeResponse
+// and the server confirms with a HandshakeResult before any WireGuard
+// traffic is forwarded. When the server is admitting anonymous peers by proof
+// of work, the Challenge also carries a puzzle the response must solve.
+
+const NonceSize = 32
+
+type Challenge struct {
+	Nonce            []byte `json:"nonce"`
+	PuzzleDifficulty int    `json:"puzzle_difficulty,omitempty"`
+}
+
+type ChallengeResponse struct {
+	Proof             []byte `json:"proof"`
+	PresharedKeyProof []byte `json:"psk_proof,omitempty"`
+	PuzzleSolution    []byte `json:"puzzle_solution,omitempty"`
+}
+
+type HandshakeResult struct {
+	OK      bool   `json:"ok"`
+	Session string `json:"session,omitempty"`
+}
+
+const (
+	proofLabel  = "kraken proof-of-possession v1"
+	pskLabel    = "kraken preshared key v1"
+	puzzleLabel = "kraken admission puzzle v1"
+)
+
+var ErrBadKey = errors.New("invalid curve25519 key")
+
+// ProveKey shows possession of clientPriv by keying a MAC over the server's
+// nonce with the static Diffie-Hellman secret shared with the server.
+func ProveKey(clientPriv, serverPub, nonce []byte) ([]byte, error) {
+	clientPub, err := curve25519.X25519(clientPriv, curve25519.Basepoint)
+	if err != nil {
+		return nil, ErrBadKey
+	}
+	shared, err := curve25519.X25519(clientPriv, serverPub)
+	if err != nil {
+		return nil, ErrBadKey
+	}
+
+	return proofMAC(shared, nonce, clientPub, serverPub), nil
+}
+
+// VerifyProof checks a proof produced by ProveKey from the server's side.
+func VerifyProof(serverPriv, clientPub, nonce, proof []byte) bool {
+	serverPub, err := curve25519.X25519(serverPriv, curve25519.Basepoint)
+	if err != nil {
+		return false
+	}
+	shared, err := curve25519.X25519(serverPriv, clientPub)
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal(proof, proofMAC(shared, nonce, clientPub, serverPub))
+}
+
+func proofMAC(shared, nonce, clientPub, serverPub []byte) []byte {
+	mac := hmac.New(sha256.New, shared)
+	mac.Write([]byte(proofLabel))
+	mac.Write(nonce)
+	mac.Write(clientPub)
+	mac.Write(serverPub)
+	return mac.Sum(nil)
+}
+
+// ClientHandshake answers the server's challenge on c: it proves possession
+// of privKey, shows the preshared key if psk is set and solves the admission
+// puzzle if one is set. Returns the session ID the server assigned.
+func ClientHandshake(ctx context.Context, c *websocket.Conn, privKey wgtypes.Key, serverPub, psk []byte, log *Logger) (string, error) {
+	var challenge Challenge
+	err := wsjson.Read(ctx, c, &challenge)
+	if err != nil {
+		return "", err
+	}
+
+	proof, err := ProveKey(privKey[:], serverPub, challenge.Nonce)
+	if err != nil {
+		return "", err
+	}
+	resp := ChallengeResponse{Proof: proof}
+	if psk != nil {
+		resp.PresharedKeyProof = PresharedKeyProof(psk, challenge.Nonce)
+	}
+	if challenge.PuzzleDifficulty > 0 {
+		start := time.Now()
+		pub := privKey.PublicKey()
+		resp.PuzzleSolution, err = SolvePuzzle(ctx, challenge.Nonce, pub[:], challenge.PuzzleDifficulty)
+		if err != nil {
+			return "", fmt.Errorf("admission puzzle: %v", err)
+		}
+		log.Debug("solved admission puzzle", "difficulty", challenge.PuzzleDifficulty, "duration", time.Since(start))
+	}
+	err = wsjson.Write(ctx, c, resp)
+	if err != nil {
+		return "", err
+	}
+
+	var result HandshakeResult
+	err = wsjson.Read(ctx, c, &result)
+	var closeErr websocket.CloseError
+	if errors.As(err, &closeErr) {
+		return "", fmt.Errorf("handshake rejected: %s", closeErr.Reason)
+	}
+	if err != nil {
+		return "", err
+	}
+	if !result.OK {
+		return "", errors.New("handshake rejected")
+	}
+	return result.Session, nil
+}
+
+// PresharedKeyProof lets the server confirm both ends use the same preshared
+// key, so a mismatch is reported instead of WireGuard handshakes silently failing.
+func PresharedKeyProof(psk, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, psk)
+	mac.Write([]byte(pskLabel))
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// A puzzle solution is 8 bytes whose hash together with the challenge nonce
+// and the client's public key starts with difficulty zero bits, taking about
+// 2^difficulty hashes to find.
+func puzzleHash(nonce, clientPub, solution []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(puzzleLabel))
+	h.Write(nonce)
+	h.Write(clientPub)
+	h.Write(solution)
+	return h.Sum(nil)
+}
+
+func leadingZeroBits(b []byte) int {
+	n := 0
+	for _, c := range b {
+		if c != 0 {
+			return n + bits.LeadingZeros8(c)
+		}
+		n += 8
+	}
+	return n
+}
+
+// CheckPuzzle reports whether solution solves the puzzle.
+func CheckPuzzle(nonce, clientPub, solution []byte, difficulty int) bool {
+	return len(solution) == 8 && leadingZeroBits(puzzleHash(nonce, clientPub, solution)) >= difficulty
+}
+
+// SolvePuzzle searches for a solution until ctx is done.
+func SolvePuzzle(ctx context.Context, nonce, clientPub []byte, difficulty int) ([]byte, error) {
+	solution := make([]byte, 8)
+	for i := uint64(0); ; i++ {
+		// Give up once the server would have, and let other goroutines run.
+		if i%(1<<12) == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			runtime.Gosched()
+		}
+		binary.BigEndian.PutUint64(solution, i)
+		if leadingZeroBits(puzzleHash(nonce, clientPub, solution)) >= difficulty {
+			return solution, nil
+		}
+	}
+}
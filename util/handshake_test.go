@@ -0,0 +1,76 @@
+package util
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+func testKeyPair(t *testing.T) (priv, pub []byte) {
+	priv = make([]byte, curve25519.ScalarSize)
+	_, err := rand.Read(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err = curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, pub
+}
+
+func TestProveKey(t *testing.T) {
+	clientPriv, clientPub := testKeyPair(t)
+	serverPriv, serverPub := testKeyPair(t)
+	otherPriv, otherPub := testKeyPair(t)
+	nonce := make([]byte, NonceSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherNonce := append([]byte(nil), nonce...)
+	otherNonce[0] ^= 1
+
+	proof, err := ProveKey(clientPriv, serverPub, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongKeyProof, err := ProveKey(otherPriv, serverPub, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherServerProof, err := ProveKey(clientPriv, otherPub, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		serverPriv []byte
+		clientPub  []byte
+		nonce      []byte
+		proof      []byte
+		ok         bool
+	}{
+		{"round trip", serverPriv, clientPub, nonce, proof, true},
+		{"wrong client key", serverPriv, clientPub, nonce, wrongKeyProof, false},
+		{"claimed for another client", serverPriv, otherPub, nonce, proof, false},
+		{"proof for another server", serverPriv, clientPub, nonce, otherServerProof, false},
+		{"checked by another server", otherPriv, clientPub, nonce, proof, false},
+		{"replayed under a new nonce", serverPriv, clientPub, otherNonce, proof, false},
+		{"truncated", serverPriv, clientPub, nonce, proof[:len(proof)-1], false},
+		{"empty", serverPriv, clientPub, nonce, nil, false},
+		{"low order client key", serverPriv, make([]byte, 32), nonce, proof, false},
+	}
+	for _, tt := range tests {
+		if ok := VerifyProof(tt.serverPriv, tt.clientPub, tt.nonce, tt.proof); ok != tt.ok {
+			t.Errorf("%s: got %v, want %v", tt.name, ok, tt.ok)
+		}
+	}
+
+	_, err = ProveKey(clientPriv, make([]byte, 32), nonce)
+	if err != ErrBadKey {
+		t.Errorf("proving to a low order server key: got %v, want %v", err, ErrBadKey)
+	}
+}
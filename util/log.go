@@ -0,0 +1,258 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+type LogLevel int32
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int32(l))
+}
+
+func ParseLogLevel(s string) (LogLevel, error) {
+	for l := LevelDebug; l <= LevelError; l++ {
+		if s == l.String() {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q: want debug, info, warn or error", s)
+}
+
+type LogFormat int32
+
+const (
+	FormatText LogFormat = iota
+	FormatJSON
+)
+
+func ParseLogFormat(s string) (LogFormat, error) {
+	switch s {
+	case "text":
+		return FormatText, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return 0, fmt.Errorf("unknown log format %q: want text or json", s)
+}
+
+// Receives each formatted log line, without a trailing newline.
+type LogSink func(level LogLevel, line string)
+
+// A sink writing one line per entry to w.
+func WriterSink(w io.Writer) LogSink {
+	var mu sync.Mutex
+	return func(level LogLevel, line string) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		io.WriteString(w, line+"\n")
+	}
+}
+
+// Shared by a logger and everything derived from it with With.
+type logOutput struct {
+	sink   LogSink
+	level  atomic.Int32
+	format atomic.Int32
+}
+
+// A leveled logger writing text or JSON lines of key-value pairs.
+type Logger struct {
+	out   *logOutput
+	attrs []any
+}
+
+func NewLogger(sink LogSink, format LogFormat, level LogLevel) *Logger {
+	out := &logOutput{sink: sink}
+	out.level.Store(int32(level))
+	out.format.Store(int32(format))
+	return &Logger{out: out}
+}
+
+// With returns a logger that adds the key-value pairs kv to every line.
+func (l *Logger) With(kv ...any) *Logger {
+	attrs := make([]any, 0, len(l.attrs)+len(kv))
+	attrs = append(attrs, l.attrs...)
+	attrs = append(attrs, kv...)
+	return &Logger{out: l.out, attrs: attrs}
+}
+
+// SetLevel changes the level of l and every logger sharing its output.
+func (l *Logger) SetLevel(level LogLevel) {
+	l.out.level.Store(int32(level))
+}
+
+// SetFormat changes the format of l and every logger sharing its output.
+func (l *Logger) SetFormat(format LogFormat) {
+	l.out.format.Store(int32(format))
+}
+
+func (l *Logger) Enabled(level LogLevel) bool {
+	return level >= LogLevel(l.out.level.Load())
+}
+
+func (l *Logger) Debug(msg string, kv ...any) {
+	l.Log(LevelDebug, msg, kv...)
+}
+
+func (l *Logger) Info(msg string, kv ...any) {
+	l.Log(LevelInfo, msg, kv...)
+}
+
+func (l *Logger) Warn(msg string, kv ...any) {
+	l.Log(LevelWarn, msg, kv...)
+}
+
+func (l *Logger) Error(msg string, kv ...any) {
+	l.Log(LevelError, msg, kv...)
+}
+
+// Fatal logs at error level and exits.
+func (l *Logger) Fatal(msg string, kv ...any) {
+	l.Log(LevelError, msg, kv...)
+	os.Exit(1)
+}
+
+func (l *Logger) Log(level LogLevel, msg string, kv ...any) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	attrs := l.attrs
+	if len(kv) > 0 {
+		attrs = append(append([]any{}, l.attrs...), kv...)
+	}
+	now := time.Now()
+	if LogFormat(l.out.format.Load()) == FormatJSON {
+		l.out.sink(level, formatJSON(now, level, msg, attrs))
+	} else {
+		l.out.sink(level, formatText(now, level, msg, attrs))
+	}
+}
+
+// DeviceLogger routes wireguard-go's log output into l, verbose lines at
+// debug level. attrs, if not nil, adds key-value pairs based on the message.
+func (l *Logger) DeviceLogger(attrs func(msg string) []any) *device.Logger {
+	logf := func(level LogLevel) func(string, ...any) {
+		return func(format string, args ...any) {
+			if !l.Enabled(level) {
+				return
+			}
+			msg := fmt.Sprintf(format, args...)
+			var kv []any
+			if attrs != nil {
+				kv = attrs(msg)
+			}
+			l.Log(level, msg, append([]any{"component", "wireguard"}, kv...)...)
+		}
+	}
+	return &device.Logger{Verbosef: logf(LevelDebug), Errorf: logf(LevelError)}
+}
+
+// Walk key-value pairs, tolerating a missing final value.
+func eachAttr(attrs []any, f func(key string, value any)) {
+	for i := 0; i < len(attrs); i += 2 {
+		key := fmt.Sprint(attrs[i])
+		if i+1 == len(attrs) {
+			f("!BADKEY", attrs[i])
+			return
+		}
+		f(key, attrs[i+1])
+	}
+}
+
+func formatText(now time.Time, level LogLevel, msg string, attrs []any) string {
+	var b strings.Builder
+	b.WriteString(now.Format("2006-01-02T15:04:05.000Z07:00"))
+	b.WriteByte(' ')
+	b.WriteString(strings.ToUpper(level.String()))
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	eachAttr(attrs, func(key string, value any) {
+		b.WriteByte(' ')
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(quoteIfNeeded(fmt.Sprint(logValue(value))))
+	})
+	return b.String()
+}
+
+func formatJSON(now time.Time, level LogLevel, msg string, attrs []any) string {
+	var b strings.Builder
+	b.WriteString(`{"time":`)
+	writeJSONValue(&b, now.Format(time.RFC3339Nano))
+	b.WriteString(`,"level":`)
+	writeJSONValue(&b, level.String())
+	b.WriteString(`,"msg":`)
+	writeJSONValue(&b, msg)
+	eachAttr(attrs, func(key string, value any) {
+		b.WriteByte(',')
+		writeJSONValue(&b, key)
+		b.WriteByte(':')
+		writeJSONValue(&b, logValue(value))
+	})
+	b.WriteByte('}')
+	return b.String()
+}
+
+func writeJSONValue(b *strings.Builder, v any) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		out, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(out)
+}
+
+// Errors and other Stringers are logged as their text.
+func logValue(v any) any {
+	switch v := v.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func quoteIfNeeded(s string) string {
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if r == '"' || r == '=' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
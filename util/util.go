@@ -3,10 +3,10 @@ package util
 import (
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 )
 
 const (
-	ServerPubKey         = "kraKENyGAX30e06miiNHxAzFNHIKxunMdUCZnjPhTCU="
 	ServerVirtualAddress = "dead:beef::5a11:b0a7"
 	ServerVirtualPort    = 80
 	ServerPhysicalPort   = 80
@@ -39,3 +39,13 @@ func Base64KeyToUrl(key string) string {
 
 	return base64.RawURLEncoding.EncodeToString(keyBytes)
 }
+
+// ParseKey decodes a base64 WireGuard key such as a preshared key.
+func ParseKey(key string) ([]byte, error) {
+	keyBytes, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(keyBytes) != 32 {
+		return nil, errors.New("invalid key: expected 32 base64-encoded bytes")
+	}
+
+	return keyBytes, nil
+}